@@ -0,0 +1,81 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"time"
+)
+
+// The size of the buffer captures are read through.
+const CAPTURE_BUFFER = 1 << 16
+
+// The error returned when a capture is neither a pcap nor a pcapng file.
+var ErrFormat = errors.New("not a pcap or pcapng file")
+
+// A packet as read from a capture, before it is decoded.
+type RawPacket struct {
+	Data      []byte    // The captured bytes, which may be cut short
+	Time      time.Time // When the packet was captured
+	Length    int       // The length of the packet on the wire
+	LinkType  LinkType  // The link-layer header type of Data
+	Interface int       // The index of the capturing interface in the file
+	Comment   string    // Any comment attached to the packet
+}
+
+// Reads the packets of a capture, in the order they were written. ReadPacket
+// returns io.EOF once there are no more packets. The packets returned are
+// not reused by the reader.
+type PacketReader interface {
+	ReadPacket() (*RawPacket, error)
+}
+
+// Decodes the packet, as DecodeLink does, and records the interface it was
+// captured on.
+func (p *Packet) DecodeRaw(raw *RawPacket) error {
+	err := p.DecodeLink(raw.LinkType, raw.Data, raw.Time)
+	p.Interface = raw.Interface
+	return err
+}
+
+// Creates a PcapReader or a PcapngReader, whichever the capture in r is.
+func NewCaptureReader(r io.Reader) (PacketReader, error) {
+	buffered := bufio.NewReaderSize(r, CAPTURE_BUFFER)
+	magic, _ := buffered.Peek(4)
+	// Readers are returned as interfaces only on success, so that a failed
+	// open gives a nil PacketReader.
+	switch {
+	case IsPcapng(magic):
+		pr, err := NewPcapngReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return pr, nil
+	case IsPcap(magic):
+		pr, err := NewPcapReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return pr, nil
+	}
+	return nil, ErrFormat
+}
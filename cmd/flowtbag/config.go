@@ -0,0 +1,59 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Reads a TOML configuration file and applies its settings. Each key names a
+// command line option, with underscores in place of dashes, for example:
+//
+//	flow_timeout = "120s"
+//	idle_threshold = "1s"
+//
+// Options given on the command line take precedence over the file.
+func loadConfig(fileName string) error {
+	var settings map[string]interface{}
+	if _, err := toml.DecodeFile(fileName, &settings); err != nil {
+		return err
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for key, value := range settings {
+		name := strings.Replace(key, "_", "-", -1)
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", fileName, key)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("%s: %s: %s", fileName, key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/danielarndt/flowtbag"
+)
+
+// Create some constants
+const (
+	TAB       = "\t"
+	COPYRIGHT = "Copyright (C) 2010 Daniel Arndt\n" +
+		"Licensed under the Apache License, Version 2.0 (the \"License\"); " +
+		"you may not use this file except in compliance with the License. " +
+		"You may obtain a copy of the License at\n" +
+		"\n    http://www.apache.org/licenses/LICENSE-2.0\n" +
+		"\nFor more information, please visit: \n" +
+		"http://web.cs.dal.ca/~darndt/projects/flowtbag"
+
+	// How often idle flows are expired when capturing from a live interface.
+	LIVE_CLEANUP_INTERVAL = 10 * time.Second
+)
+
+// The units which time based features can be exported in.
+var timeUnits = map[string]time.Duration{
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// The output formats which can be given with -format.
+var exportFormats = map[string]func(w io.Writer, schema flowtbag.Record,
+	header bool) flowtbag.Exporter{
+	"csv": flowtbag.NewCsvExporter,
+	"json": func(w io.Writer, schema flowtbag.Record,
+		header bool) flowtbag.Exporter {
+		return flowtbag.NewJsonExporter(w)
+	},
+	"parquet": func(w io.Writer, schema flowtbag.Record,
+		header bool) flowtbag.Exporter {
+		return flowtbag.NewParquetExporter(w, schema)
+	},
+}
+
+// Display a welcome message
+func displayWelcome() {
+	log.Println("\nWelcome to Flowtbag2 0.1b")
+	log.Print("\n" + COPYRIGHT + "\n\n")
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "%s [options] <capture file>...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "%s [options] - (to read a capture from stdin)\n",
+		os.Args[0])
+	fmt.Fprintf(os.Stderr, "%s [options] -i <interface>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "options:\n")
+	flag.PrintDefaults()
+}
+
+var (
+	fileNames      []string
+	device         string
+	configFile     string
+	reportInterval int64
+	timeUnitName   string
+	format         string
+	outputName     string
+	header         bool
+	workers        int
+	strict         bool
+	filterExpr     string
+	filter         *flowtbag.Filter
+	featureList    string
+	listFeatures   bool
+	cfg            = flowtbag.DefaultConfig
+	exporter       flowtbag.Exporter
+)
+
+func parseFlags() {
+	flag.Int64Var(&reportInterval, "r", 500000,
+		"The interval, in packets, at which to report the current state of "+
+			"Flowtbag and expire idle flows")
+	flag.StringVar(&device, "i", "",
+		"Capture from the given network interface instead of a capture file")
+	flag.StringVar(&timeUnitName, "time-unit", "us",
+		"The unit in which time based features are exported: us, ms or s")
+	flag.DurationVar(&cfg.FlowTimeout, "flow-timeout", cfg.FlowTimeout,
+		"The time after which an inactive flow is expired")
+	flag.DurationVar(&cfg.IdleThreshold, "idle-threshold", cfg.IdleThreshold,
+		"The gap between packets after which a flow is considered idle")
+	flag.DurationVar(&cfg.FragTimeout, "frag-timeout", cfg.FragTimeout,
+		"The time to wait for the fragments of an IP datagram")
+	flag.Int64Var(&cfg.FragMemory, "frag-memory", cfg.FragMemory,
+		"The most memory, in bytes, to hold IP fragments in")
+	flag.StringVar(&format, "format", "csv",
+		"The output format: csv, json (JSON Lines) or parquet")
+	flag.StringVar(&outputName, "o", "",
+		"Write flows to the given file instead of stdout")
+	flag.BoolVar(&header, "header", false,
+		"Write a header row naming the columns in csv output")
+	flag.IntVar(&workers, "workers", runtime.NumCPU(),
+		"The number of goroutines decoding packets, and of flow table shards")
+	flag.BoolVar(&cfg.ExportInterface, "interface-column", false,
+		"Export the capture interface of each flow, as numbered in pcapng files")
+	flag.BoolVar(&strict, "strict", false,
+		"Stop at the first truncated, corrupt or malformed packet, or the "+
+			"first with a bad IPv4 header checksum")
+	flag.StringVar(&filterExpr, "f", "",
+		"Only build flows from packets matching the given pcap-style filter. "+
+			"Capture files are filtered by flowtbag, which supports only a "+
+			"subset of the BPF syntax (host, net, port, portrange, proto, "+
+			"vlan, less and greater); live captures are filtered by libpcap")
+	flag.StringVar(&featureList, "features", "",
+		"The features to export, as a comma separated list of feature names "+
+			"and groups, any prefixed with - to leave them out")
+	flag.BoolVar(&listFeatures, "list-features", false,
+		"List the exported columns, with their types, and exit")
+	flag.StringVar(&configFile, "config", "",
+		"Read settings from the given TOML configuration file")
+	flag.Parse()
+	if configFile != "" {
+		if err := loadConfig(configFile); err != nil {
+			log.Fatalf("Error reading configuration: %s\n", err)
+		}
+	}
+	if reportInterval <= 0 {
+		log.Fatalln("The report interval must be positive.")
+	}
+	if workers < 1 {
+		log.Fatalln("At least one worker is needed.")
+	}
+	unit, ok := timeUnits[timeUnitName]
+	if !ok {
+		usage()
+		fmt.Println()
+		log.Fatalf("Unknown time unit: %s\n", timeUnitName)
+	}
+	cfg.TimeUnit = unit
+	var err error
+	cfg.ExportFeatures, err = cfg.SelectFeatures(featureList)
+	if err != nil {
+		log.Fatalf("Error in -features: %s\n", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Error in settings: %s\n", err)
+	}
+	if listFeatures {
+		printFeatures(os.Stdout)
+		os.Exit(0)
+	}
+	// Live captures are filtered by libpcap instead.
+	if device == "" {
+		if filter, err = flowtbag.ParseFilter(filterExpr); err != nil {
+			log.Fatalf("Error in filter %q: %s\n", filterExpr, err)
+		}
+	}
+	if _, ok := exportFormats[format]; !ok {
+		usage()
+		fmt.Println()
+		log.Fatalf("Unknown output format: %s\n", format)
+	}
+	fileNames = flag.Args()
+	if len(fileNames) == 0 && device == "" {
+		usage()
+		fmt.Println()
+		log.Fatalln("Missing required filename or interface.")
+	}
+	if len(fileNames) > 0 && device != "" {
+		usage()
+		fmt.Println()
+		log.Fatalln("Specify either a filename or an interface, not both.")
+	}
+}
+
+// Prints the flow keys and features which would be exported, each with its
+// groups, columns and their types, in column order, and then the groups.
+func printFeatures(w io.Writer) {
+	for _, feature := range cfg.Features() {
+		fmt.Fprintf(w, "%s: %s", feature.Name, feature.Doc)
+		if len(feature.Groups) > 0 {
+			fmt.Fprintf(w, " (%s)", strings.Join(feature.Groups, ", "))
+		}
+		fmt.Fprintln(w)
+		for _, col := range feature.Columns {
+			typ := "NUMERIC"
+			if _, ok := col.Value.(string); ok {
+				typ = "STRING"
+			}
+			fmt.Fprintf(w, "    %s %s\n", col.Name, typ)
+		}
+	}
+	fmt.Fprintf(w, "groups: %s\n", strings.Join(flowtbag.FeatureGroups(), ", "))
+}
+
+// Adds the packets of a live capture to the pipeline until the capture fails
+// or the program is interrupted. Flows which have been idle for longer than
+// the flow timeout are expired on a wall-clock ticker, since a quiet interface
+// may not deliver packets often enough to trigger the regular cleanup.
+func captureLive(packets <-chan *flowtbag.RawPacket, pl *pipeline) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(LIVE_CLEANUP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case rawpkt, ok := <-packets:
+			if !ok {
+				return
+			}
+			pl.add(rawpkt)
+			if len(packets) == 0 {
+				// Caught up with the capture, so don't hold on to a
+				// partial batch.
+				pl.flush()
+			}
+		case now := <-ticker.C:
+			pl.expire(now)
+		case sig := <-interrupt:
+			log.Printf("Received %s. Exporting remaining flows.\n", sig)
+			return
+		}
+	}
+}
+
+// Reads every packet of the capture files.
+func readFiles(reader packetSource, pl *pipeline) {
+	for {
+		raw, err := reader.ReadPacket()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatalf("Error reading packets: %s\n", err)
+		}
+		pl.add(raw)
+	}
+}
+
+func main() {
+	parseFlags()
+	displayWelcome()
+	var (
+		live   <-chan *flowtbag.RawPacket
+		reader packetSource
+		err    error
+	)
+	if device != "" {
+		live, err = openLive(device, filterExpr)
+		if err != nil {
+			log.Fatalf("Cannot capture from %s: %s\n", device, err)
+		}
+	} else {
+		files, err := expandFiles(fileNames)
+		if err != nil {
+			log.Fatalf("Cannot read packets: %s\n", err)
+		}
+		reader, err = newMerger(files)
+		if err != nil {
+			log.Fatalf("Cannot read packets: %s\n", err)
+		}
+	}
+
+	output := os.Stdout
+	if outputName != "" {
+		output, err = os.Create(outputName)
+		if err != nil {
+			log.Fatalf("Error creating output file: %s\n", err)
+		}
+	}
+	exporter = exportFormats[format](output, cfg.Schema(), header)
+
+	log.Println("Starting Flowtbag")
+	pl := newPipeline(workers)
+	if device != "" {
+		captureLive(live, pl)
+	} else {
+		readFiles(reader, pl)
+	}
+	pl.close()
+	log.Printf("Read %d packets. Not decoded: %s\n", pl.seq-1, &pl.stats)
+	if filterExpr != "" && device == "" {
+		log.Printf("%d packets did not match the filter\n", pl.filtered)
+	}
+	if pl.badChecksum > 0 {
+		log.Printf("%d packets had a bad IPv4 header checksum, and were "+
+			"kept\n", pl.badChecksum)
+	}
+	if pl.reordered > 0 {
+		log.Printf("%d packets were earlier than the last of their flow, "+
+			"and were skipped\n", pl.reordered)
+	}
+	defragStats := pl.defrag.Stats()
+	log.Printf("Reassembly: %s\n", &defragStats)
+	if reader != nil {
+		reader.Close()
+	}
+	if err := exporter.Close(); err != nil {
+		log.Fatalf("Error writing flows: %s\n", err)
+	}
+	if err := output.Close(); err != nil {
+		log.Fatalf("Error writing flows: %s\n", err)
+	}
+}
+
+var (
+	startTime time.Time
+	endTime   time.Time
+	elapsed   time.Duration
+)
+
+func printStackTrace() {
+	n := 1
+	for {
+		p, f, l, ok := runtime.Caller(n)
+		if !ok {
+			break
+		}
+		log.Printf("%s (%s:%d)\n", runtime.FuncForPC(p).Name(), f, l)
+		n++
+	}
+}
@@ -0,0 +1,83 @@
+//go:build pcap
+
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/akrennmair/gopcap"
+	"github.com/danielarndt/flowtbag"
+)
+
+// Settings used when capturing from a live interface.
+const (
+	LIVE_SNAPLEN    = 65535
+	LIVE_TIMEOUT_MS = 1000
+)
+
+// Starts capturing from a network interface with libpcap, and returns the
+// packets as they arrive. A non-empty filter is compiled by libpcap, in its
+// full syntax, and applied to the packets as captured. The channel is closed
+// if the capture fails.
+func openLive(device string, filter string) (<-chan *flowtbag.RawPacket,
+	error) {
+	log.Printf("%s\n", pcap.Version())
+	p, err := pcap.Openlive(device, LIVE_SNAPLEN, true, LIVE_TIMEOUT_MS)
+	if p == nil {
+		return nil, err
+	}
+	link := flowtbag.LinkType(p.Datalink())
+	if err := link.Check(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if filter != "" {
+		if err := p.Setfilter(filter); err != nil {
+			p.Close()
+			return nil, fmt.Errorf("error in filter %q: %s", filter, err)
+		}
+	}
+	packets := make(chan *flowtbag.RawPacket, 1024)
+	go func() {
+		defer close(packets)
+		for {
+			rawpkt, result := p.NextEx()
+			switch result {
+			case 1:
+				packets <- &flowtbag.RawPacket{
+					Data:     rawpkt.Data,
+					Time:     rawpkt.Time,
+					Length:   int(rawpkt.Len),
+					LinkType: link,
+				}
+			case 0:
+				// Read timeout expired. Nothing to do.
+			default:
+				log.Printf("Live capture on %s stopped: %s\n", device,
+					p.Geterror())
+				return
+			}
+		}
+	}()
+	return packets, nil
+}
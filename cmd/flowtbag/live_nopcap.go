@@ -0,0 +1,36 @@
+//go:build !pcap
+
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package main
+
+import (
+	"errors"
+
+	"github.com/danielarndt/flowtbag"
+)
+
+// Live capture needs libpcap, which is left out unless flowtbag is built with
+// the pcap tag.
+func openLive(device string, filter string) (<-chan *flowtbag.RawPacket,
+	error) {
+	return nil, errors.New("live capture is not supported by this build. " +
+		"Rebuild flowtbag with -tags pcap to capture with libpcap")
+}
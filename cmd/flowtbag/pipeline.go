@@ -0,0 +1,489 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package main
+
+// Packets flow through the pipeline in four stages:
+//
+//  1. The reader (the caller of add) groups packets into batches, in capture
+//     order.
+//  2. Workers decode the batches concurrently.
+//  3. The dispatcher takes the decoded batches back in capture order, and
+//     hands each packet to the shard owning its flow. Each shard is a
+//     FlowTable owned by a single goroutine.
+//  4. The writer merges the flows finished by the shards and exports them in
+//     the order they were finished.
+//
+// Every packet gets a sequence number, and every finished flow is tagged with
+// an order key derived from the sequence number of the packet which finished
+// it. Since each shard finishes flows in increasing key order, the writer can
+// merge them once every shard has reported progress past a key. The output is
+// therefore the same whatever the number of workers, apart from the order of
+// flows expired at the same time, which has always been arbitrary.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danielarndt/flowtbag"
+)
+
+// The number of packets handed between the stages at a time.
+const BATCH_SIZE = 256
+
+// Marks a decoded packet which does not match the filter.
+var errFiltered = errors.New("filtered out")
+
+// Flows finished while expiring the table at packet seq are ordered before
+// those finished by the packet itself.
+func expireKey(seq int64) int64 { return 2 * seq }
+func packetKey(seq int64) int64 { return 2*seq + 1 }
+
+// A batch of captured packets, in capture order.
+type batch struct {
+	first int64 // Sequence number of the first packet
+	raw   []*flowtbag.RawPacket
+	pkts  []flowtbag.Packet
+	errs  []error       // Why each packet could not be decoded, if it wasn't
+	done  chan struct{} // Closed once the batch is decoded
+	tick  time.Time     // If set, expire the flows at this time instead
+	refs  int32         // Stages still using the decoded packets
+}
+
+// Batches are reused once every shard is done with their packets, so that
+// decoding does not allocate.
+var batchPool = sync.Pool{
+	New: func() interface{} {
+		return &batch{
+			raw:  make([]*flowtbag.RawPacket, 0, BATCH_SIZE),
+			pkts: make([]flowtbag.Packet, BATCH_SIZE),
+			errs: make([]error, BATCH_SIZE),
+		}
+	},
+}
+
+// Returns the batch to the pool once nothing is using it.
+func (b *batch) release() {
+	if atomic.AddInt32(&b.refs, -1) > 0 {
+		return
+	}
+	for i := range b.raw {
+		b.raw[i] = nil
+	}
+	b.raw = b.raw[:0]
+	for i := range b.errs {
+		b.errs[i] = nil
+	}
+	batchPool.Put(b)
+}
+
+type shardPacket struct {
+	key int64
+	pkt *flowtbag.Packet
+}
+
+// The work handed to a shard. The flows are first expired (if expire is set),
+// then the packets are added, then the table is flushed (if flush is set).
+type shardJob struct {
+	expire    time.Time
+	expireKey int64
+	sync      bool // Whether the output should be flushed after expiring
+	pkts      []shardPacket
+	batch     *batch // The batch holding the packets
+	flush     bool
+	mark      int64 // The shard has seen everything up to this key
+}
+
+type keyedRecord struct {
+	key int64
+	rec flowtbag.Record
+}
+
+// What a shard did with a shardJob.
+type shardResult struct {
+	shard   int
+	mark    int64
+	recs    []keyedRecord
+	expired bool // Whether the job expired flows
+	sync    bool
+	key     int64 // The key of the expiry
+	removed int   // Flows removed by the expiry
+	active  int   // Flows left in the table after the expiry
+	// Packets skipped for being earlier than the last of their flow
+	reordered int64
+}
+
+// Collects the records of the flows finished by a shard.
+type collector struct {
+	key  int64
+	recs []keyedRecord
+}
+
+func (c *collector) Export(rec flowtbag.Record) error {
+	c.recs = append(c.recs, keyedRecord{c.key, rec})
+	return nil
+}
+
+func (c *collector) Flush() error { return nil }
+func (c *collector) Close() error { return nil }
+
+type pipeline struct {
+	seq     int64 // Sequence number of the next packet
+	pending *batch
+	decode  chan *batch // Batches waiting to be decoded
+	ordered chan *batch // Batches in capture order, for the dispatcher
+	shards  []chan shardJob
+	results chan shardResult
+	done    chan struct{} // Closed once the writer is finished
+	defrag  *flowtbag.Defragmenter
+
+	// Only to be read once the pipeline is closed
+	stats       flowtbag.DecodeStats
+	filtered    int64 // Packets which did not match the filter
+	reordered   int64 // Packets earlier than the last of their flow
+	badChecksum int64 // Packets kept despite a bad IPv4 header checksum
+}
+
+// Starts a pipeline with the given number of decoding workers and shards.
+func newPipeline(workers int) *pipeline {
+	p := &pipeline{
+		seq:     1,
+		decode:  make(chan *batch, workers*4),
+		ordered: make(chan *batch, workers*4),
+		shards:  make([]chan shardJob, workers),
+		results: make(chan shardResult, workers*4),
+		done:    make(chan struct{}),
+		defrag:  flowtbag.NewDefragmenter(cfg),
+	}
+	for i := 0; i < workers; i++ {
+		go p.decoder()
+	}
+	var shards sync.WaitGroup
+	for i := range p.shards {
+		p.shards[i] = make(chan shardJob, 4)
+		shards.Add(1)
+		go func(i int) {
+			defer shards.Done()
+			p.shard(i)
+		}(i)
+	}
+	go func() {
+		shards.Wait()
+		close(p.results)
+	}()
+	go p.dispatcher()
+	go p.writer()
+	return p
+}
+
+// Adds a captured packet to the pipeline.
+func (p *pipeline) add(raw *flowtbag.RawPacket) {
+	if p.pending == nil {
+		p.pending = batchPool.Get().(*batch)
+		p.pending.first = p.seq
+	}
+	p.pending.raw = append(p.pending.raw, raw)
+	p.seq++
+	if len(p.pending.raw) == BATCH_SIZE {
+		p.flush()
+	}
+}
+
+func (p *pipeline) send(b *batch) {
+	b.done = make(chan struct{})
+	p.ordered <- b
+	p.decode <- b
+}
+
+// Sends any packets waiting to be batched on their way.
+func (p *pipeline) flush() {
+	if p.pending != nil {
+		p.send(p.pending)
+		p.pending = nil
+	}
+}
+
+// Expires the flows which have been inactive at the given (wall-clock) time,
+// and flushes the output.
+func (p *pipeline) expire(now time.Time) {
+	p.flush()
+	p.send(&batch{first: p.seq, tick: now})
+}
+
+// Finishes all the flows and waits until they have been exported.
+func (p *pipeline) close() {
+	p.flush()
+	close(p.decode)
+	close(p.ordered)
+	<-p.done
+}
+
+func (p *pipeline) decoder() {
+	for b := range p.decode {
+		for i, raw := range b.raw {
+			err := decodePacket(&b.pkts[i], raw)
+			if err == nil && !filter.Match(&b.pkts[i]) {
+				err = errFiltered
+			}
+			b.errs[i] = err
+		}
+		close(b.done)
+	}
+}
+
+// Decodes a packet. A packet which makes the decoder panic is reported as
+// malformed, like any other damaged packet, rather than ending the run. A
+// packet with a bad IPv4 header checksum is only rejected in a strict run.
+func decodePacket(pkt *flowtbag.Packet, raw *flowtbag.RawPacket) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: decoder failed: %v", flowtbag.ErrMalformed,
+				r)
+		}
+	}()
+	return checkChecksum(pkt, pkt.DecodeRaw(raw))
+}
+
+// Returns ErrChecksum for a decoded packet with a bad IPv4 header checksum in
+// a strict run, and err otherwise.
+func checkChecksum(pkt *flowtbag.Packet, err error) error {
+	if err == nil && pkt.BadChecksum && strict {
+		return flowtbag.ErrChecksum
+	}
+	return err
+}
+
+func (p *pipeline) shardOf(pkt *flowtbag.Packet) int {
+	return int(pkt.Hash() % uint32(len(p.shards)))
+}
+
+// Hands the decoded packets to the shards, in capture order.
+func (p *pipeline) dispatcher() {
+	jobs := make([][]shardPacket, len(p.shards))
+	// Sends the packets of b collected so far, letting every shard know that
+	// it has seen everything before mark.
+	send := func(b *batch, mark int64) {
+		for i := range p.shards {
+			job := shardJob{pkts: jobs[i], mark: mark}
+			if len(jobs[i]) > 0 {
+				job.batch = b
+				atomic.AddInt32(&b.refs, 1)
+			}
+			p.shards[i] <- job
+			jobs[i] = nil
+		}
+	}
+	broadcast := func(job shardJob) {
+		for i := range p.shards {
+			p.shards[i] <- job
+		}
+	}
+	var seq int64
+	startTime = time.Now()
+	for b := range p.ordered {
+		<-b.done
+		if !b.tick.IsZero() {
+			key := expireKey(b.first)
+			p.defrag.Expire(b.tick)
+			broadcast(shardJob{expire: b.tick, expireKey: key, sync: true,
+				mark: key})
+			continue
+		}
+		b.refs = 1
+		for i, raw := range b.raw {
+			seq = b.first + int64(i)
+			if (seq % reportInterval) == 0 {
+				key := expireKey(seq)
+				send(b, key-1)
+				p.defrag.Expire(raw.Time)
+				broadcast(shardJob{expire: raw.Time, expireKey: key, mark: key})
+				endTime = time.Now()
+				runtime.GC()
+				elapsed = endTime.Sub(startTime)
+				startTime = time.Now()
+				log.Printf("Currently processing packet %d.", seq)
+				log.Printf("Took %fs to process %d packets", elapsed.Seconds(),
+					reportInterval)
+			}
+			err := b.errs[i]
+			if err == flowtbag.ErrFragment {
+				// Fragments are reassembled here, since the fragments of a
+				// datagram may be decoded by different workers. The fragment
+				// completing a datagram is counted as the datagram it gives.
+				err = p.defrag.Add(&b.pkts[i], raw.Data)
+				if err == flowtbag.ErrFragment {
+					p.stats.Count(err)
+					continue
+				}
+				err = checkChecksum(&b.pkts[i], err)
+				if err == nil && !filter.Match(&b.pkts[i]) {
+					err = errFiltered
+				}
+			}
+			if err == errFiltered {
+				p.filtered++
+			} else if err != nil {
+				p.stats.Count(err)
+				// Unsupported protocols and fragments are not damaged, just
+				// not something we build flows from.
+				if flowtbag.IsMalformed(err) {
+					if strict {
+						log.Fatalf("Error decoding packet %d: %s\n", seq, err)
+					}
+					log.Printf("Error decoding packet %d: %s\n", seq, err)
+				}
+			} else {
+				if b.pkts[i].BadChecksum {
+					p.badChecksum++
+				}
+				shard := p.shardOf(&b.pkts[i])
+				jobs[shard] = append(jobs[shard],
+					shardPacket{packetKey(seq), &b.pkts[i]})
+			}
+		}
+		send(b, packetKey(seq))
+		b.release()
+	}
+	key := expireKey(seq + 1)
+	broadcast(shardJob{flush: true, mark: key})
+	for i := range p.shards {
+		close(p.shards[i])
+	}
+}
+
+// Owns the FlowTable of a single shard.
+func (p *pipeline) shard(i int) {
+	var c collector
+	table, err := flowtbag.NewFlowTable(cfg, func(f *flowtbag.Flow) {
+		if err := f.Export(&c); err != nil {
+			log.Fatalf("Error exporting flow: %s\n", err)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Error in settings: %s\n", err)
+	}
+	for job := range p.shards[i] {
+		res := shardResult{shard: i, mark: job.mark}
+		if !job.expire.IsZero() {
+			c.key = job.expireKey
+			res.expired, res.sync, res.key = true, job.sync, job.expireKey
+			res.removed = table.Expire(job.expire)
+			res.active = table.Len()
+		}
+		for _, sp := range job.pkts {
+			c.key = sp.key
+			if addPacket(table, sp) == flowtbag.ErrReordered {
+				res.reordered++
+			}
+		}
+		if job.batch != nil {
+			job.batch.release()
+		}
+		if job.flush {
+			c.key = job.mark
+			table.Flush()
+		}
+		res.recs = c.recs
+		c.recs = nil
+		p.results <- res
+	}
+}
+
+func addPacket(table *flowtbag.FlowTable, sp shardPacket) error {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Error processing packet %d: %s", sp.key/2, err)
+			printStackTrace()
+		}
+	}()
+	return table.AddPacket(sp.pkt)
+}
+
+// An expiry which not every shard has reported on yet.
+type expiry struct {
+	shards  int
+	removed int
+	active  int
+	sync    bool
+}
+
+// Merges the flows finished by the shards, and exports them in key order.
+func (p *pipeline) writer() {
+	defer close(p.done)
+	n := len(p.shards)
+	marks := make([]int64, n)
+	queues := make([][]keyedRecord, n)
+	expiries := make(map[int64]*expiry)
+	for res := range p.results {
+		marks[res.shard] = res.mark
+		p.reordered += res.reordered
+		queues[res.shard] = append(queues[res.shard], res.recs...)
+		if res.expired {
+			e := expiries[res.key]
+			if e == nil {
+				e = new(expiry)
+				expiries[res.key] = e
+			}
+			e.shards++
+			e.removed += res.removed
+			e.active += res.active
+			e.sync = e.sync || res.sync
+		}
+		low := marks[0]
+		for _, mark := range marks[1:] {
+			if mark < low {
+				low = mark
+			}
+		}
+		for {
+			next := -1
+			for i, q := range queues {
+				if len(q) > 0 && q[0].key <= low &&
+					(next < 0 || q[0].key < queues[next][0].key) {
+					next = i
+				}
+			}
+			if next < 0 {
+				break
+			}
+			if err := exporter.Export(queues[next][0].rec); err != nil {
+				log.Fatalf("Error writing flows: %s\n", err)
+			}
+			queues[next] = queues[next][1:]
+		}
+		for key, e := range expiries {
+			if e.shards < n || key > low {
+				continue
+			}
+			log.Printf("Removed %d flows. Flowtbag size: %d\n", e.removed,
+				e.active)
+			if e.sync {
+				if err := exporter.Flush(); err != nil {
+					log.Fatalf("Error writing flows: %s\n", err)
+				}
+			}
+			delete(expiries, key)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danielarndt/flowtbag"
+)
+
+// Returns a raw IPv4 packet carrying body, with the given header checksum.
+// Zero is left as it is.
+func rawIp4(proto uint8, checksum uint16, body []byte) *flowtbag.RawPacket {
+	ip := append(make([]byte, 20), body...)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+	ip[8] = 64
+	ip[9] = proto
+	binary.BigEndian.PutUint16(ip[10:], checksum)
+	copy(ip[12:], net.ParseIP("10.0.0.1").To4())
+	copy(ip[16:], net.ParseIP("10.0.0.2").To4())
+	return &flowtbag.RawPacket{Data: ip, Time: time.Unix(1, 0),
+		Length: len(ip), LinkType: flowtbag.LINKTYPE_RAW}
+}
+
+// Returns a raw IPv4 UDP packet with the given header checksum.
+func rawPacket(checksum uint16) *flowtbag.RawPacket {
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[4:], 8)
+	return rawIp4(flowtbag.IP_UDP, checksum, udp)
+}
+
+// Splits body into two IPv4 fragments, the first of n bytes.
+func rawFragments(proto uint8, id uint16, body []byte,
+	n int) []*flowtbag.RawPacket {
+	first := rawIp4(proto, 0, body[:n])
+	second := rawIp4(proto, 0, body[n:])
+	binary.BigEndian.PutUint16(first.Data[4:], id)
+	binary.BigEndian.PutUint16(second.Data[4:], id)
+	binary.BigEndian.PutUint16(first.Data[6:], 0x2000)
+	binary.BigEndian.PutUint16(second.Data[6:], uint16(n/8))
+	return []*flowtbag.RawPacket{first, second}
+}
+
+// A bad IPv4 header checksum only stops a strict run.
+func TestDecodeChecksum(t *testing.T) {
+	saved := strict
+	defer func() { strict = saved }()
+	for _, s := range []bool{false, true} {
+		strict = s
+		var pkt flowtbag.Packet
+		err := decodePacket(&pkt, rawPacket(0x1234))
+		if s && err != flowtbag.ErrChecksum || !s && err != nil {
+			t.Errorf("strict %v: got %v", s, err)
+		}
+		// Zero is what checksum offload leaves.
+		if err := decodePacket(&pkt, rawPacket(0)); err != nil {
+			t.Errorf("strict %v: got %v for a zero checksum", s, err)
+		}
+	}
+}
+
+// Each fragment is counted once: those held for reassembly as fragments, and
+// the one completing a datagram as whatever the datagram decodes to.
+func TestPipelineFragments(t *testing.T) {
+	savedCfg, savedInterval, savedExporter := cfg, reportInterval, exporter
+	defer func() {
+		cfg, reportInterval, exporter = savedCfg, savedInterval, savedExporter
+	}()
+	cfg = flowtbag.DefaultConfig
+	reportInterval = 1000
+	exporter = flowtbag.NewCsvExporter(io.Discard, cfg.Schema(), false)
+	udp := make([]byte, 1000)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	// A TCP header length of 4 bytes.
+	tcp := make([]byte, 1000)
+	tcp[12] = 1 << 4
+	pl := newPipeline(2)
+	for _, raw := range append(rawFragments(flowtbag.IP_UDP, 1, udp, 512),
+		rawFragments(flowtbag.IP_TCP, 2, tcp, 512)...) {
+		pl.add(raw)
+	}
+	pl.close()
+	want := flowtbag.DecodeStats{Fragment: 2, Malformed: 1}
+	if pl.stats != want {
+		t.Errorf("got %s, want %s", &pl.stats, &want)
+	}
+}
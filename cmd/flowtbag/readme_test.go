@@ -0,0 +1,59 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The feature list in the README must be the output of
+// flowtbag -list-features -interface-column.
+func TestReadmeFeatures(t *testing.T) {
+	readme, err := os.ReadFile("../../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, section, ok := strings.Cut(string(readme), "\n### Features\n")
+	if !ok {
+		t.Fatal("no Features section in the README")
+	}
+	var listed strings.Builder
+	started := false
+	for _, line := range strings.Split(section, "\n") {
+		if strings.HasPrefix(line, "    ") {
+			started = true
+			listed.WriteString(line[4:] + "\n")
+		} else if started {
+			break
+		}
+	}
+	saved := cfg
+	defer func() { cfg = saved }()
+	cfg.ExportInterface = true
+	var printed bytes.Buffer
+	printFeatures(&printed)
+	if listed.String() != printed.String() {
+		t.Errorf("README lists:\n%s\nflowtbag -list-features "+
+			"-interface-column prints:\n%s", listed.String(), printed.String())
+	}
+}
@@ -0,0 +1,432 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"container/heap"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danielarndt/flowtbag"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// The magic numbers of the compressed formats captures are read from.
+var (
+	GZIP_MAGIC  = []byte{0x1f, 0x8b}
+	ZSTD_MAGIC  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	XZ_MAGIC    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	BZIP2_MAGIC = []byte{'B', 'Z', 'h'}
+)
+
+// Reads the packets of a pcapng file, logging the interfaces as they are
+// described and the comments attached to the file and its packets.
+type pcapngReader struct {
+	*flowtbag.PcapngReader
+	io.Closer
+	name     string
+	comments int // Section comments logged so far
+	ifaces   int // Interfaces logged so far
+	packets  int64
+}
+
+func (r *pcapngReader) ReadPacket() (*flowtbag.RawPacket, error) {
+	raw, err := r.PcapngReader.ReadPacket()
+	r.logNew()
+	if err != nil {
+		return nil, err
+	}
+	r.packets++
+	if raw.Comment != "" {
+		log.Printf("%s: packet %d: %s\n", r.name, r.packets, raw.Comment)
+	}
+	return raw, nil
+}
+
+// Logs the section comments and interfaces read since it was last called.
+func (r *pcapngReader) logNew() {
+	comments := r.Comments()
+	for ; r.comments < len(comments); r.comments++ {
+		log.Printf("%s: %s\n", r.name, comments[r.comments])
+	}
+	ifaces := r.Interfaces()
+	for ; r.ifaces < len(ifaces); r.ifaces++ {
+		ifc := ifaces[r.ifaces]
+		log.Printf("%s: interface %d: %s, link type %s\n", r.name, r.ifaces,
+			describe(ifc), ifc.LinkType)
+		for _, comment := range ifc.Comments {
+			log.Printf("%s: interface %d: %s\n", r.name, r.ifaces, comment)
+		}
+		if err := ifc.LinkType.Check(); err != nil {
+			log.Printf("%s: packets on interface %d will not be decoded: %s\n",
+				r.name, r.ifaces, err)
+		}
+	}
+}
+
+// Names an interface as well as the file allows.
+func describe(ifc *flowtbag.PcapngInterface) string {
+	switch {
+	case ifc.Name != "" && ifc.Description != "":
+		return fmt.Sprintf("%s (%s)", ifc.Name, ifc.Description)
+	case ifc.Name != "":
+		return ifc.Name
+	case ifc.Description != "":
+		return ifc.Description
+	}
+	return "unnamed"
+}
+
+// Logs the packets the capturing interfaces reported as dropped.
+func (r *pcapngReader) logStats() {
+	for i, ifc := range r.Interfaces() {
+		if ifc.Received >= 0 {
+			log.Printf("%s: interface %d: %d packets received\n", r.name, i,
+				ifc.Received)
+		}
+		if ifc.Accepted >= 0 {
+			log.Printf("%s: interface %d: %d packets accepted by the "+
+				"filter\n", r.name, i, ifc.Accepted)
+		}
+		if ifc.IfDropped >= 0 {
+			log.Printf("%s: interface %d: %d packets dropped by the "+
+				"interface\n", r.name, i, ifc.IfDropped)
+		}
+		if ifc.OSDropped >= 0 {
+			log.Printf("%s: interface %d: %d packets dropped by the OS\n",
+				r.name, i, ifc.OSDropped)
+		}
+		if ifc.Dropped > 0 {
+			log.Printf("%s: interface %d: %d packets lost between captured "+
+				"packets\n", r.name, i, ifc.Dropped)
+		}
+	}
+}
+
+func (r *pcapngReader) Close() error {
+	r.logStats()
+	return r.Closer.Close()
+}
+
+// A PacketReader which must be closed once read.
+type packetSource interface {
+	flowtbag.PacketReader
+	io.Closer
+}
+
+// Closes a capture file along with the decompressor reading it.
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var first error
+	for i := len(c) - 1; i >= 0; i-- {
+		if err := c[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Returns a reader of the decompressed contents of r, if r is compressed
+// with gzip, zstd, xz or bzip2, along with anything to close once done.
+func decompress(r *bufio.Reader) (io.Reader, io.Closer, error) {
+	magic, _ := r.Peek(len(XZ_MAGIC))
+	switch {
+	case bytes.HasPrefix(magic, GZIP_MAGIC):
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return z, z, nil
+	case bytes.HasPrefix(magic, ZSTD_MAGIC):
+		z, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return z, z.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, XZ_MAGIC):
+		z, err := xz.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return z, nil, nil
+	case bytes.HasPrefix(magic, BZIP2_MAGIC):
+		return bzip2.NewReader(r), nil, nil
+	}
+	return r, nil, nil
+}
+
+// The name standing for standard input among the capture files.
+const STDIN = "-"
+
+// Opens a capture file, which may be in pcap or pcapng format, and may be
+// compressed. The file named STDIN is read from standard input.
+func openCapture(name string) (flowtbag.PacketReader, io.Closer, error) {
+	file := os.Stdin
+	if name != STDIN {
+		var err error
+		file, err = os.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	c := closers{file}
+	r, z, err := decompress(bufio.NewReader(file))
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if z != nil {
+		c = append(c, z)
+	}
+	reader, err := flowtbag.NewCaptureReader(r)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if pr, ok := reader.(*flowtbag.PcapReader); ok {
+		if err := pr.LinkType().Check(); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+	return reader, c, nil
+}
+
+// Opens a capture file for reading its packets into flows.
+func openFile(name string) (packetSource, error) {
+	reader, c, err := openCapture(name)
+	if err != nil {
+		return nil, err
+	}
+	if pr, ok := reader.(*flowtbag.PcapngReader); ok {
+		if name == STDIN {
+			name = "standard input"
+		}
+		return &pcapngReader{PcapngReader: pr, Closer: c, name: name}, nil
+	}
+	return struct {
+		flowtbag.PacketReader
+		io.Closer
+	}{reader, c}, nil
+}
+
+// Expands any glob patterns among the names of capture files. Names without
+// any pattern characters are kept as they are.
+func expandFiles(names []string) ([]string, error) {
+	var files []string
+	for _, name := range names {
+		if name == STDIN || !strings.ContainsAny(name, "*?[") {
+			files = append(files, name)
+			continue
+		}
+		matches, err := filepath.Glob(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no matching files", name)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// A capture file taking part in a merge.
+type mergeFile struct {
+	name   string
+	first  time.Time // The time of its first packet
+	source packetSource
+	next   *flowtbag.RawPacket // The next packet to be merged
+}
+
+// The open files of a merge, by the time of their next packet.
+type mergeHeap []*mergeFile
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeFile)) }
+func (h mergeHeap) Less(i, j int) bool {
+	return h[i].next.Time.Before(h[j].next.Time)
+}
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
+
+// Reads the packets of several capture files as one capture, in timestamp
+// order, so that flows carry on from one file into the next. Files are only
+// opened once the merge reaches their first packet, so rotated captures are
+// read one or two at a time however many there are.
+type merger struct {
+	pending []*mergeFile // Not yet opened, by the time of their first packet
+	open    mergeHeap
+}
+
+// Finds the time of the first packet of each file, and prepares to merge
+// them. Files without any packets are left out, as are files whose first
+// packet cannot be read, unless the run is strict. Standard input cannot be
+// read twice, so it is kept open from the start.
+func newMerger(names []string) (*merger, error) {
+	m := new(merger)
+	stdin := false
+	for _, name := range names {
+		if name == STDIN {
+			if stdin {
+				return nil, fmt.Errorf("%s may only be given once", STDIN)
+			}
+			stdin = true
+			f, err := m.openStdin()
+			if err != nil {
+				return nil, err
+			}
+			if f != nil {
+				m.pending = append(m.pending, f)
+			}
+			continue
+		}
+		reader, c, err := openCapture(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		raw, err := reader.ReadPacket()
+		c.Close()
+		if err == io.EOF {
+			log.Printf("%s has no packets.\n", name)
+			continue
+		}
+		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			log.Printf("Error reading %s: %s. Skipping the file.\n", name,
+				err)
+			continue
+		}
+		m.pending = append(m.pending, &mergeFile{name: name, first: raw.Time})
+	}
+	sort.SliceStable(m.pending, func(i, j int) bool {
+		return m.pending[i].first.Before(m.pending[j].first)
+	})
+	return m, nil
+}
+
+// Opens standard input and reads its first packet. Returns nil if it has no
+// packets.
+func (m *merger) openStdin() (*mergeFile, error) {
+	source, err := openFile(STDIN)
+	if err != nil {
+		return nil, fmt.Errorf("standard input: %s", err)
+	}
+	f := &mergeFile{name: "standard input", source: source}
+	if err := m.advance(f); err != nil {
+		return nil, err
+	}
+	if f.next == nil {
+		log.Printf("Standard input has no packets.\n")
+		return nil, nil
+	}
+	f.first = f.next.Time
+	return f, nil
+}
+
+// Reads the next packet of a file, closing the file once it has no more. A
+// file which is damaged part way through is read up to the damage, unless
+// the run is strict.
+func (m *merger) advance(f *mergeFile) error {
+	raw, err := f.source.ReadPacket()
+	if err == nil {
+		f.next = raw
+		return nil
+	}
+	f.next = nil
+	f.source.Close()
+	if err == io.EOF {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("%s: %s", f.name, err)
+	}
+	log.Printf("Error reading %s: %s. Skipping the rest of the file.\n",
+		f.name, err)
+	return nil
+}
+
+func (m *merger) ReadPacket() (*flowtbag.RawPacket, error) {
+	for len(m.pending) > 0 &&
+		(len(m.open) == 0 || !m.pending[0].first.After(m.open[0].next.Time)) {
+		f := m.pending[0]
+		m.pending = m.pending[1:]
+		if f.source == nil {
+			source, err := openFile(f.name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", f.name, err)
+			}
+			f.source = source
+			if err := m.advance(f); err != nil {
+				return nil, err
+			}
+		}
+		if f.next != nil {
+			heap.Push(&m.open, f)
+		}
+	}
+	if len(m.open) == 0 {
+		return nil, io.EOF
+	}
+	f := m.open[0]
+	raw := f.next
+	if err := m.advance(f); err != nil {
+		return nil, err
+	}
+	if f.next == nil {
+		heap.Pop(&m.open)
+	} else {
+		heap.Fix(&m.open, 0)
+	}
+	return raw, nil
+}
+
+// Closes any files still open.
+func (m *merger) Close() error {
+	for _, f := range m.open {
+		f.source.Close()
+	}
+	for _, f := range m.pending {
+		if f.source != nil {
+			f.source.Close()
+		}
+	}
+	m.open, m.pending = nil, nil
+	return nil
+}
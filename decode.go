@@ -0,0 +1,410 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ETHER_HLEN    = 14
+	ETHERTYPE_IP  = 0x0800
+	ETHERTYPE_IP6 = 0x86dd
+
+	IP4_MIN_HLEN = 20
+	IP6_HLEN     = 40
+	TCP_MIN_HLEN = 20
+	UDP_HLEN     = 8
+	SCTP_HLEN    = 12
+	CHUNK_HLEN   = 4
+
+	// IPv6 extension headers which may appear between the fixed header and
+	// the upper layer protocol.
+	IP6_HOPOPTS  = 0
+	IP6_ROUTING  = 43
+	IP6_FRAGMENT = 44
+	IP6_AH       = 51
+	IP6_DSTOPTS  = 60
+	IP6_MOBILITY = 135
+	IP6_HIP      = 139
+	IP6_SHIM6    = 140
+)
+
+// The reasons a packet may not be decoded. Errors returned by Decode are, or
+// wrap, one of these.
+var (
+	ErrTruncated   = errors.New("truncated packet")
+	ErrChecksum    = errors.New("bad checksum") // Not returned by Decode
+	ErrUnsupported = errors.New("unsupported protocol")
+	ErrFragment    = errors.New("non-first fragment")
+	ErrMalformed   = errors.New("malformed packet")
+)
+
+// Counts the packets which could not be decoded, by reason.
+type DecodeStats struct {
+	Truncated   int64
+	Checksum    int64
+	Unsupported int64
+	Fragment    int64
+	Malformed   int64
+}
+
+// Counts a packet for which Decode returned err. Nothing is counted for a nil
+// error.
+func (s *DecodeStats) Count(err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrTruncated):
+		s.Truncated++
+	case errors.Is(err, ErrChecksum):
+		s.Checksum++
+	case errors.Is(err, ErrUnsupported):
+		s.Unsupported++
+	case errors.Is(err, ErrFragment):
+		s.Fragment++
+	default:
+		s.Malformed++
+	}
+}
+
+// Returns the number of packets counted.
+func (s *DecodeStats) Total() int64 {
+	return s.Truncated + s.Checksum + s.Unsupported + s.Fragment + s.Malformed
+}
+
+func (s *DecodeStats) String() string {
+	return fmt.Sprintf("%d truncated, %d bad checksum, %d unsupported "+
+		"protocol, %d fragment, %d malformed", s.Truncated, s.Checksum,
+		s.Unsupported, s.Fragment, s.Malformed)
+}
+
+// Returns whether an error returned by Decode means that the packet was
+// damaged, rather than just not something flows are built from.
+func IsMalformed(err error) bool {
+	return err != nil && !errors.Is(err, ErrUnsupported) &&
+		!errors.Is(err, ErrFragment)
+}
+
+// Returns whether the checksum of an IPv4 header is valid. A zero checksum is
+// accepted, since it is what captures show when the checksum is offloaded to
+// the network card.
+func ip4ChecksumValid(hdr []byte) bool {
+	if binary.BigEndian.Uint16(hdr[10:12]) == 0 {
+		return true
+	}
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return sum == 0xffff
+}
+
+// A decoded packet, ready to be added to a FlowTable. A Packet holds no
+// references to the captured data, so it may be reused as soon as it has been
+// added.
+type Packet struct {
+	SrcIP   Addr
+	SrcPort uint16
+	DstIP   Addr
+	DstPort uint16
+	Proto   uint8
+
+	Time       int64  // Microseconds since the epoch
+	Len        int64  // Length of the IP packet, including the IP header
+	IPHLen     int64  // Length of the IP header, and any IPv6 extensions
+	PrHLen     int64  // Length of the TCP header, or the UDP length field
+	PayloadLen int64  // Length of the TCP or UDP payload
+	Flags      uint8  // TCP flags
+	DSCP       uint8  // DSCP, or the upper bits of the IPv6 traffic class
+	TTL        uint8  // TTL, or the IPv6 hop limit
+	Window     uint16 // TCP window
+	Chunks     uint32 // SCTP chunk types, as a set of bits
+
+	IcmpType uint8
+	IcmpCode uint8
+	IcmpSeq  uint16  // Sequence number of echo requests and replies
+	Inner    FlowKey // For ICMP errors, the flow of the quoted packet
+	HasInner bool    // Whether Inner is set
+
+	Fragments int64 // The number of fragments the packet was reassembled from
+	Evasive   bool  // Whether the fragments overlapped, or looked evasive
+
+	// Whether an IPv4 header checksum was wrong. Such packets are decoded
+	// all the same, since captures taken on the sending host show packets
+	// whose checksum is left to the network card. Callers wanting to reject
+	// them can treat them as ErrChecksum.
+	BadChecksum bool
+
+	VLAN      uint16 // The ID of the outer VLAN tag
+	InnerVLAN uint16 // The ID of the inner VLAN tag, for QinQ
+	TunnelID  uint32 // The key, VNI or TEID of the innermost tunnel
+
+	Interface int // The capture interface, as numbered by the reader
+
+	frag  fragment // Where to find the fragment, if Decode gave ErrFragment
+	depth int      // The number of encapsulation headers stripped
+}
+
+// Describes an IP fragment within the captured data.
+type fragment struct {
+	start   int    // Offset of the IP header in the captured data
+	hlen    int    // Length of the headers which are not fragmented
+	dataOff int    // Offset of the fragment data from the IP header
+	nextOff int    // For IPv6, offset of the next header naming the fragment header
+	next    uint8  // The protocol of the reassembled packet
+	id      uint32 // Identification of the datagram
+	offset  int    // Offset of the fragment data in the datagram
+	length  int    // Length of the fragment data
+	more    bool   // Whether more fragments follow
+	version uint8
+}
+
+// Decodes an ethernet frame carrying an IPv4 or IPv6 packet, captured at the
+// given time. VLAN tags, MPLS labels, PPPoE and tunnels are stripped to get
+// at the innermost IP packet. Packets which are not IP give ErrUnsupported,
+// and damaged packets give one of the other errors above. Fragments give
+// ErrFragment, and may be passed on to a Defragmenter.
+func (p *Packet) Decode(data []byte, timestamp time.Time) error {
+	*p = Packet{Time: timestamp.UnixMicro()}
+	return p.decodeEthernet(data, 0)
+}
+
+// Decodes the IP packet found at offset in data, with the given ethertype.
+func (p *Packet) decodeNetwork(ethertype uint16, data []byte, offset int) error {
+	var (
+		payload []byte
+		err     error
+	)
+	if offset > len(data) {
+		return ErrTruncated
+	}
+	switch ethertype {
+	case ETHERTYPE_IP:
+		payload, err = p.decodeIp4(data[offset:])
+	case ETHERTYPE_IP6:
+		payload, err = p.decodeIp6(data[offset:])
+	default:
+		return ErrUnsupported
+	}
+	if err == ErrFragment {
+		p.frag.start = offset
+	}
+	if err != nil {
+		return err
+	}
+	if tunnel, err := p.decodeTunnel(data, len(data)-len(payload)); tunnel {
+		return err
+	}
+	return p.decodeTransport(payload)
+}
+
+// Decodes an IPv4 header and returns the upper layer payload.
+func (p *Packet) decodeIp4(data []byte) ([]byte, error) {
+	if len(data) < IP4_MIN_HLEN {
+		return nil, ErrTruncated
+	}
+	if data[0]>>4 != 4 {
+		return nil, fmt.Errorf("%w: bad IPv4 version %d", ErrMalformed,
+			data[0]>>4)
+	}
+	hlen := int(data[0]&0x0f) * 4
+	if hlen < IP4_MIN_HLEN {
+		return nil, fmt.Errorf("%w: IPv4 header length %d", ErrMalformed,
+			hlen)
+	}
+	if len(data) < hlen {
+		return nil, ErrTruncated
+	}
+	if !ip4ChecksumValid(data[:hlen]) {
+		p.BadChecksum = true
+	}
+	p.IPHLen = int64(hlen)
+	p.DSCP = data[1] >> 2
+	p.Len = int64(binary.BigEndian.Uint16(data[2:4]))
+	p.TTL = data[8]
+	p.Proto = data[9]
+	p.SrcIP = addr4(data[12:16])
+	p.DstIP = addr4(data[16:20])
+	flags := binary.BigEndian.Uint16(data[6:8])
+	if flags&0x3fff != 0 {
+		// Either more fragments follow, or this is not the first.
+		p.frag = fragment{
+			hlen:    hlen,
+			dataOff: hlen,
+			next:    p.Proto,
+			id:      uint32(binary.BigEndian.Uint16(data[4:6])),
+			offset:  int(flags&0x1fff) * 8,
+			length:  int(p.Len) - hlen,
+			more:    flags&0x2000 != 0,
+			version: 4,
+		}
+		return nil, ErrFragment
+	}
+	return data[hlen:], nil
+}
+
+// Decodes an IPv6 header, walking the chain of extension headers until the
+// upper layer protocol is found, and returns the upper layer payload. The
+// extension headers are counted as part of the IP header length.
+func (p *Packet) decodeIp6(data []byte) ([]byte, error) {
+	if len(data) < IP6_HLEN {
+		return nil, ErrTruncated
+	}
+	if data[0]>>4 != 6 {
+		return nil, fmt.Errorf("%w: bad IPv6 version %d", ErrMalformed,
+			data[0]>>4)
+	}
+	trafficClass := (binary.BigEndian.Uint16(data[0:2]) >> 4) & 0xff
+	p.DSCP = uint8(trafficClass >> 2)
+	p.Len = IP6_HLEN + int64(binary.BigEndian.Uint16(data[4:6]))
+	p.TTL = data[7]
+	copy(p.SrcIP[:], data[8:24])
+	copy(p.DstIP[:], data[24:40])
+	next := data[6]
+	nextOff := 6
+	hlen := IP6_HLEN
+	for {
+		var extlen int
+		switch next {
+		case IP6_HOPOPTS, IP6_ROUTING, IP6_DSTOPTS, IP6_MOBILITY, IP6_HIP,
+			IP6_SHIM6:
+			if len(data) < hlen+2 {
+				return nil, ErrTruncated
+			}
+			extlen = (int(data[hlen+1]) + 1) * 8
+		case IP6_AH:
+			if len(data) < hlen+2 {
+				return nil, ErrTruncated
+			}
+			extlen = (int(data[hlen+1]) + 2) * 4
+		case IP6_FRAGMENT:
+			if len(data) < hlen+8 {
+				return nil, ErrTruncated
+			}
+			flags := binary.BigEndian.Uint16(data[hlen+2 : hlen+4])
+			if flags&0xfff9 != 0 {
+				// Either more fragments follow, or this is not the first.
+				// Atomic fragments are decoded as they are.
+				p.frag = fragment{
+					hlen:    hlen,
+					dataOff: hlen + 8,
+					nextOff: nextOff,
+					next:    data[hlen],
+					id:      binary.BigEndian.Uint32(data[hlen+4 : hlen+8]),
+					offset:  int(flags & 0xfff8),
+					length:  int(p.Len) - hlen - 8,
+					more:    flags&1 != 0,
+					version: 6,
+				}
+				return nil, ErrFragment
+			}
+			extlen = 8
+		default:
+			p.IPHLen = int64(hlen)
+			p.Proto = next
+			return data[hlen:], nil
+		}
+		if len(data) < hlen+extlen {
+			return nil, ErrTruncated
+		}
+		next = data[hlen]
+		nextOff = hlen
+		hlen += extlen
+	}
+}
+
+// Decodes the TCP, UDP, SCTP or ICMP header at the start of data. Other
+// protocols have no ports, so their flows are identified by the addresses
+// and protocol alone.
+func (p *Packet) decodeTransport(data []byte) error {
+	switch p.Proto {
+	case IP_TCP:
+		if len(data) < TCP_MIN_HLEN {
+			return ErrTruncated
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:2])
+		p.DstPort = binary.BigEndian.Uint16(data[2:4])
+		p.PrHLen = int64(data[12]>>4) * 4
+		if p.PrHLen < TCP_MIN_HLEN {
+			return fmt.Errorf("%w: TCP header length %d", ErrMalformed,
+				p.PrHLen)
+		}
+		p.Flags = data[13]
+		p.Window = binary.BigEndian.Uint16(data[14:16])
+		p.PayloadLen = p.Len - p.IPHLen - p.PrHLen
+	case IP_UDP:
+		if len(data) < UDP_HLEN {
+			return ErrTruncated
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:2])
+		p.DstPort = binary.BigEndian.Uint16(data[2:4])
+		p.PrHLen = int64(binary.BigEndian.Uint16(data[4:6]))
+		p.PayloadLen = p.Len - p.IPHLen - UDP_HLEN
+	case IP_SCTP:
+		if len(data) < SCTP_HLEN {
+			return ErrTruncated
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:2])
+		p.DstPort = binary.BigEndian.Uint16(data[2:4])
+		p.PrHLen = SCTP_HLEN
+		p.PayloadLen = p.Len - p.IPHLen - SCTP_HLEN
+		if err := p.decodeChunks(data[SCTP_HLEN:]); err != nil {
+			return err
+		}
+	case IP_ICMP, IP_ICMP6:
+		if err := p.decodeIcmp(data); err != nil {
+			return err
+		}
+	default:
+		p.PayloadLen = p.Len - p.IPHLen
+	}
+	if p.PayloadLen < 0 {
+		p.PayloadLen = 0
+	}
+	return nil
+}
+
+// Collects the types of the SCTP chunks following the common header. Chunks
+// cut off by the capture length are ignored.
+func (p *Packet) decodeChunks(data []byte) error {
+	for len(data) >= CHUNK_HLEN {
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if length < CHUNK_HLEN {
+			return fmt.Errorf("%w: SCTP chunk length %d", ErrMalformed,
+				length)
+		}
+		if data[0] < 32 {
+			p.Chunks |= 1 << data[0]
+		}
+		// Chunks are padded to a multiple of 4 bytes.
+		length = (length + 3) &^ 3
+		if length > len(data) {
+			break
+		}
+		data = data[length:]
+	}
+	return nil
+}
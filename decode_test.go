@@ -0,0 +1,67 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"testing"
+	"time"
+)
+
+// Packets with a bad IPv4 header checksum are decoded, and marked.
+func TestDecodeChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		sum  []byte // The checksum to write, or nil to keep the right one
+		bad  bool
+	}{
+		{"valid", nil, false},
+		{"offloaded", []byte{0, 0}, false},
+		{"bad", []byte{0x12, 0x34}, true},
+	}
+	for _, test := range tests {
+		ip := ip4("10.0.0.1", "10.0.0.2", IP_UDP, udp(1000, 53, 10))
+		if test.sum != nil {
+			copy(ip[10:12], test.sum)
+		}
+		var p Packet
+		err := p.Decode(ether(ETHERTYPE_IP, ip), time.Unix(1, 0))
+		if err != nil || p.BadChecksum != test.bad || p.DstPort != 53 ||
+			p.Len != int64(len(ip)) {
+			t.Errorf("%s: got %v, %+v", test.name, err, p)
+		}
+	}
+	// The mark is kept through reassembly.
+	body := udp(1000, 53, 3000-UDP_HLEN)
+	d := NewDefragmenter(DefaultConfig)
+	var p Packet
+	var err error
+	for i, f := range []testFragment{{off: 0, n: 1480, more: true},
+		{off: 1480, n: 1520}} {
+		frame := frag4(f, body)
+		if i == 1 {
+			frame[ETHER_HLEN+10] ^= 0xff
+		}
+		p.Decode(frame, time.Unix(1, 0))
+		err = d.Add(&p, frame)
+	}
+	if err != nil || !p.BadChecksum {
+		t.Errorf("reassembled: got %v, %+v", err, p)
+	}
+}
@@ -0,0 +1,337 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// The largest IP datagram which can be reassembled.
+	MAX_DATAGRAM = 65535
+	// The memory charged for each fragment held, on top of its data.
+	FRAG_OVERHEAD = 64
+)
+
+// Counts what a Defragmenter has done with the fragments given to it.
+type DefragStats struct {
+	Fragments   int64 // Fragments added
+	Reassembled int64 // Datagrams reassembled
+	Overlapping int64 // Datagrams with overlapping fragments
+	Evasive     int64 // Datagrams with conflicting or otherwise suspicious fragments
+	TimedOut    int64 // Datagrams dropped before all of their fragments arrived
+	Dropped     int64 // Datagrams dropped to stay within the memory limit
+}
+
+func (s *DefragStats) String() string {
+	return fmt.Sprintf("%d fragments, %d datagrams reassembled, %d "+
+		"overlapping, %d evasive, %d timed out, %d dropped over the memory "+
+		"limit", s.Fragments, s.Reassembled, s.Overlapping, s.Evasive,
+		s.TimedOut, s.Dropped)
+}
+
+// Identifies the datagram a fragment belongs to.
+type fragKey struct {
+	src       Addr
+	dst       Addr
+	id        uint32
+	proto     uint8 // Zero for IPv6, where it is not part of the identification
+	version   uint8
+	vlan      uint16
+	innerVlan uint16
+	tunnelID  uint32
+}
+
+// The data of a fragment. data may be shorter than length, when the capture
+// did not keep the whole packet.
+type fragPiece struct {
+	offset int
+	length int
+	data   []byte
+}
+
+// A datagram waiting for its fragments.
+type datagram struct {
+	key     fragKey
+	first   int64       // The time the first fragment to arrive was captured
+	header  []byte      // The headers of the fragment at offset zero
+	nextOff int         // For IPv6, where the next header is set in header
+	next    uint8       // The protocol of the reassembled datagram
+	pieces  []fragPiece // In the order they arrived
+	end     int         // The length of the datagram, or -1 if not yet known
+	size    int         // The memory held
+	overlap bool        // Whether any fragments overlapped
+	evasive bool        // Whether any fragments looked evasive
+	badSum  bool        // Whether any fragments had a bad IPv4 checksum
+	done    bool        // Whether the datagram has been removed
+}
+
+// Reassembles fragmented IPv4 and IPv6 datagrams, so that they can be added
+// to a FlowTable. Where fragments overlap, the data which arrived first is
+// kept. Overlaps whose data differ, first fragments too short to hold the
+// transport header, and fragments which do not fit in a datagram are
+// counted as evasive.
+//
+// Datagrams which are not complete within the fragment timeout of the Config
+// are dropped, as are the oldest datagrams when the fragments held would take
+// more than its fragment memory.
+type Defragmenter struct {
+	cfg       Config
+	datagrams map[fragKey]*datagram
+	order     []*datagram // In the order their first fragment arrived
+	memory    int
+	stats     DefragStats
+	buf       []byte // The last reassembled datagram
+}
+
+// Creates a Defragmenter with the fragment limits of cfg.
+func NewDefragmenter(cfg Config) *Defragmenter {
+	return &Defragmenter{
+		cfg:       cfg,
+		datagrams: make(map[fragKey]*datagram),
+	}
+}
+
+// Returns what the Defragmenter has done so far.
+func (d *Defragmenter) Stats() DefragStats {
+	return d.stats
+}
+
+// Returns the length of the smallest header of a protocol, or zero if it is
+// not known.
+func minTransportHeader(proto uint8) int {
+	switch proto {
+	case IP_TCP:
+		return TCP_MIN_HLEN
+	case IP_UDP:
+		return UDP_HLEN
+	case IP_SCTP:
+		return SCTP_HLEN
+	case IP_ICMP, IP_ICMP6:
+		return ICMP_HLEN
+	}
+	return 0
+}
+
+// Adds a packet for which Decode gave ErrFragment, along with the data it was
+// decoded from. Once every fragment of its datagram has been added, the
+// reassembled datagram is decoded into p and the result of decoding it is
+// returned. Until then, ErrFragment is returned.
+func (d *Defragmenter) Add(p *Packet, data []byte) error {
+	f := p.frag
+	d.stats.Fragments++
+	d.expire(p.Time)
+	key := fragKey{src: p.SrcIP, dst: p.DstIP, id: f.id, version: f.version,
+		vlan: p.VLAN, innerVlan: p.InnerVLAN, tunnelID: p.TunnelID}
+	if f.version == 4 {
+		key.proto = f.next
+	}
+	dg := d.datagrams[key]
+	if dg == nil {
+		dg = &datagram{key: key, first: p.Time, end: -1}
+		d.datagrams[key] = dg
+		d.order = append(d.order, dg)
+	}
+	if f.length <= 0 || f.offset+f.length > MAX_DATAGRAM ||
+		(f.more && f.length%8 != 0) {
+		dg.evasive = true
+		return ErrFragment
+	}
+	start := f.start + f.dataOff
+	stop := start + f.length
+	if stop > len(data) {
+		stop = len(data)
+	}
+	if start > stop {
+		start = stop
+	}
+	dg.badSum = dg.badSum || p.BadChecksum
+	piece := fragPiece{offset: f.offset, length: f.length}
+	for _, other := range dg.pieces {
+		if piece.offset < other.offset+other.length &&
+			other.offset < piece.offset+piece.length {
+			dg.overlap = true
+			if !overlapMatches(other, piece.offset, data[start:stop]) {
+				dg.evasive = true
+			}
+		}
+	}
+	piece.data = append([]byte(nil), data[start:stop]...)
+	dg.pieces = append(dg.pieces, piece)
+	size := len(piece.data) + FRAG_OVERHEAD
+	if f.offset == 0 && dg.header == nil {
+		dg.header = append([]byte(nil), data[f.start:f.start+f.hlen]...)
+		dg.nextOff = f.nextOff
+		dg.next = f.next
+		size += len(dg.header)
+		if f.more && f.length < minTransportHeader(f.next) {
+			dg.evasive = true
+		}
+	}
+	if !f.more {
+		if dg.end >= 0 && dg.end != f.offset+f.length {
+			dg.evasive = true
+		} else {
+			dg.end = f.offset + f.length
+		}
+	}
+	dg.size += size
+	d.memory += size
+	for d.memory > int(d.cfg.FragMemory) && len(d.order) > 0 {
+		oldest := d.order[0]
+		d.order = d.order[1:]
+		if !oldest.done {
+			d.stats.Dropped++
+			d.remove(oldest)
+		}
+	}
+	if dg.done || !dg.complete() {
+		return ErrFragment
+	}
+	return d.reassemble(p, dg)
+}
+
+// Returns whether the data of a piece at offset agrees with what is already
+// held in other, where the two overlap and both were captured.
+func overlapMatches(other fragPiece, offset int, data []byte) bool {
+	lo, hi := offset, offset+len(data)
+	if other.offset > lo {
+		lo = other.offset
+	}
+	if end := other.offset + len(other.data); end < hi {
+		hi = end
+	}
+	for i := lo; i < hi; i++ {
+		if data[i-offset] != other.data[i-other.offset] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether every byte of the datagram has arrived.
+func (dg *datagram) complete() bool {
+	if dg.header == nil || dg.end < 0 {
+		return false
+	}
+	covered := 0
+	for covered < dg.end {
+		next := covered
+		for _, piece := range dg.pieces {
+			if piece.offset <= covered && piece.offset+piece.length > next {
+				next = piece.offset + piece.length
+			}
+		}
+		if next == covered {
+			return false
+		}
+		covered = next
+	}
+	return true
+}
+
+// Builds the datagram from its fragments, and decodes it into p.
+func (d *Defragmenter) reassemble(p *Packet, dg *datagram) error {
+	d.stats.Reassembled++
+	fragments := int64(len(dg.pieces))
+	evasive := dg.overlap || dg.evasive
+	d.remove(dg)
+	hlen := len(dg.header)
+	length := hlen + dg.end
+	if dg.key.version == 6 {
+		// The IPv6 payload length does not include the fixed header.
+		length -= IP6_HLEN
+	}
+	if length > MAX_DATAGRAM {
+		return fmt.Errorf("%w: reassembled datagram of %d bytes",
+			ErrMalformed, length)
+	}
+	d.buf = append(d.buf[:0], dg.header...)
+	for i := 0; i < dg.end; i++ {
+		d.buf = append(d.buf, 0)
+	}
+	// Copy the pieces in reverse, so that the data which arrived first wins.
+	for i := len(dg.pieces) - 1; i >= 0; i-- {
+		piece := dg.pieces[i]
+		if piece.offset < dg.end {
+			copy(d.buf[hlen+piece.offset:], piece.data)
+		}
+	}
+	var ethertype uint16
+	if dg.key.version == 4 {
+		ethertype = ETHERTYPE_IP
+		binary.BigEndian.PutUint16(d.buf[2:4], uint16(length))
+		binary.BigEndian.PutUint16(d.buf[6:8], 0)
+		// A zero checksum is taken as not computed.
+		binary.BigEndian.PutUint16(d.buf[10:12], 0)
+	} else {
+		ethertype = ETHERTYPE_IP6
+		binary.BigEndian.PutUint16(d.buf[4:6], uint16(length))
+		d.buf[dg.nextOff] = dg.next
+	}
+	*p = Packet{Time: p.Time, VLAN: dg.key.vlan, InnerVLAN: dg.key.innerVlan,
+		TunnelID: dg.key.tunnelID, Interface: p.Interface}
+	err := p.decodeNetwork(ethertype, d.buf, 0)
+	p.Fragments = fragments
+	p.Evasive = evasive
+	p.BadChecksum = p.BadChecksum || dg.badSum
+	return err
+}
+
+// Forgets a datagram, and counts how its fragments looked.
+func (d *Defragmenter) remove(dg *datagram) {
+	dg.done = true
+	delete(d.datagrams, dg.key)
+	d.memory -= dg.size
+	if dg.overlap {
+		d.stats.Overlapping++
+	}
+	if dg.evasive {
+		d.stats.Evasive++
+	}
+}
+
+// Drops the datagrams which have waited longer than the fragment timeout at
+// the given time (in microseconds).
+func (d *Defragmenter) expire(now int64) int {
+	count := 0
+	for len(d.order) > 0 {
+		oldest := d.order[0]
+		if !oldest.done &&
+			now-oldest.first <= d.cfg.FragTimeout.Microseconds() {
+			break
+		}
+		d.order = d.order[1:]
+		if !oldest.done {
+			count++
+			d.stats.TimedOut++
+			d.remove(oldest)
+		}
+	}
+	return count
+}
+
+// Drops the datagrams which have waited longer than the fragment timeout at
+// the given time, and returns how many there were.
+func (d *Defragmenter) Expire(now time.Time) int {
+	return d.expire(now.UnixMicro())
+}
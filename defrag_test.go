@@ -0,0 +1,192 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// A fragment of a test datagram.
+type testFragment struct {
+	id   uint32
+	off  int  // Offset of the fragment data in the datagram
+	n    int  // Length of the fragment data
+	more bool // Whether more fragments follow
+	alt  bool // Whether the data is taken from the altered datagram
+	at   time.Duration
+}
+
+// Returns the data of a fragment of body, which is zeros past its end.
+func (f testFragment) data(body []byte) []byte {
+	if f.off+f.n > len(body) {
+		return make([]byte, f.n)
+	}
+	return body[f.off : f.off+f.n]
+}
+
+// Returns an ethernet frame holding an IPv4 fragment of body.
+func frag4(f testFragment, body []byte) []byte {
+	ip := ip4("10.0.0.1", "10.0.0.2", IP_UDP, f.data(body))
+	binary.BigEndian.PutUint16(ip[4:], uint16(f.id))
+	flags := uint16(f.off / 8)
+	if f.more {
+		flags |= 0x2000
+	}
+	binary.BigEndian.PutUint16(ip[6:], flags)
+	ip4Checksum(ip)
+	return ether(ETHERTYPE_IP, ip)
+}
+
+// Returns an ethernet frame holding an IPv6 fragment of body.
+func frag6(f testFragment, body []byte) []byte {
+	ip := make([]byte, IP6_HLEN+8)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(8+f.n))
+	ip[6] = 44 // Fragment header
+	ip[7] = 64
+	copy(ip[8:], net.ParseIP("2001:db8::1"))
+	copy(ip[24:], net.ParseIP("2001:db8::2"))
+	ip[IP6_HLEN] = IP_UDP
+	offset := uint16(f.off)
+	if f.more {
+		offset |= 1
+	}
+	binary.BigEndian.PutUint16(ip[IP6_HLEN+2:], offset)
+	binary.BigEndian.PutUint32(ip[IP6_HLEN+4:], f.id)
+	return ether(ETHERTYPE_IP6, cat(ip, f.data(body)))
+}
+
+func TestDefrag(t *testing.T) {
+	// A UDP datagram of 3000 bytes, and a copy altered at byte 1200.
+	body := udp(4000, 53, 3000-UDP_HLEN)
+	for i := UDP_HLEN; i < len(body); i++ {
+		body[i] = byte(i % 251)
+	}
+	alt := append([]byte(nil), body...)
+	alt[1200] ^= 0xff
+	tests := []struct {
+		name   string
+		v6     bool
+		memory int64 // The fragment memory, if not the default
+		frags  []testFragment
+		// What the last fragment gave, and for a reassembled datagram, the
+		// number of fragments and whether they looked evasive
+		err       error
+		fragments int64
+		evasive   bool
+		stats     DefragStats
+	}{
+		{name: "in order",
+			frags: []testFragment{{off: 0, n: 1480, more: true},
+				{off: 1480, n: 1480, more: true}, {off: 2960, n: 40}},
+			fragments: 3, stats: DefragStats{Fragments: 3, Reassembled: 1}},
+		{name: "reversed",
+			frags: []testFragment{{off: 2960, n: 40},
+				{off: 1480, n: 1480, more: true}, {off: 0, n: 1480, more: true}},
+			fragments: 3, stats: DefragStats{Fragments: 3, Reassembled: 1}},
+		{name: "ipv6", v6: true,
+			frags: []testFragment{{off: 0, n: 1232, more: true},
+				{off: 1232, n: 1768}},
+			fragments: 2, stats: DefragStats{Fragments: 2, Reassembled: 1}},
+		{name: "overlapping",
+			frags: []testFragment{{off: 0, n: 1480, more: true},
+				{off: 1000, n: 1000, more: true}, {off: 1480, n: 1520}},
+			fragments: 3, evasive: true,
+			stats: DefragStats{Fragments: 3, Reassembled: 1, Overlapping: 1}},
+		// The data which arrived first is kept.
+		{name: "overlapping with other data",
+			frags: []testFragment{{off: 0, n: 1480, more: true},
+				{off: 1000, n: 1000, more: true, alt: true},
+				{off: 1480, n: 1520}},
+			fragments: 3, evasive: true,
+			stats: DefragStats{Fragments: 3, Reassembled: 1, Overlapping: 1,
+				Evasive: 1}},
+		{name: "duplicate",
+			frags: []testFragment{{off: 0, n: 1480, more: true},
+				{off: 0, n: 1480, more: true}, {off: 1480, n: 1520}},
+			fragments: 3, evasive: true,
+			stats: DefragStats{Fragments: 3, Reassembled: 1, Overlapping: 1}},
+		{name: "beyond the largest datagram",
+			frags: []testFragment{{off: 0, n: 1480, more: true},
+				{off: 65528, n: 16, more: true}, {off: 1480, n: 1520}},
+			fragments: 2, evasive: true,
+			stats: DefragStats{Fragments: 3, Reassembled: 1, Evasive: 1}},
+		// The first datagram times out, and the last fragment starts another.
+		{name: "never completed",
+			frags: []testFragment{{off: 0, n: 1480, more: true},
+				{off: 1480, n: 1520, at: 31 * time.Second}},
+			err: ErrFragment, stats: DefragStats{Fragments: 2, TimedOut: 1}},
+		// Each datagram is dropped when the next would take the fragments
+		// held over 2000 bytes.
+		{name: "over the memory limit", memory: 2000,
+			frags: []testFragment{{id: 1, off: 0, n: 1480, more: true},
+				{id: 2, off: 0, n: 1480, more: true},
+				{id: 1, off: 1480, n: 1520}},
+			err: ErrFragment, stats: DefragStats{Fragments: 3, Dropped: 2}},
+	}
+	base := time.Unix(1000, 0)
+	for _, test := range tests {
+		cfg := DefaultConfig
+		if test.memory > 0 {
+			cfg.FragMemory = test.memory
+		}
+		d := NewDefragmenter(cfg)
+		var p Packet
+		var err error
+		for i, f := range test.frags {
+			data := body
+			if f.alt {
+				data = alt
+			}
+			frame := frag4(f, data)
+			if test.v6 {
+				frame = frag6(f, data)
+			}
+			if err = p.Decode(frame, base.Add(f.at)); err != ErrFragment {
+				t.Fatalf("%s: decoding fragment %d gave %v", test.name, i,
+					err)
+			}
+			err = d.Add(&p, frame)
+			if i < len(test.frags)-1 && err != ErrFragment {
+				t.Fatalf("%s: fragment %d gave %v", test.name, i, err)
+			}
+		}
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+		if err == nil {
+			if p.Fragments != test.fragments || p.Evasive != test.evasive ||
+				p.SrcPort != 4000 || p.DstPort != 53 ||
+				p.PayloadLen != int64(len(body)-UDP_HLEN) {
+				t.Errorf("%s: reassembled %+v", test.name, p)
+			}
+			if !bytes.Equal(d.buf[len(d.buf)-len(body):], body) {
+				t.Errorf("%s: reassembled the wrong data", test.name)
+			}
+		}
+		if stats := d.Stats(); stats != test.stats {
+			t.Errorf("%s: got %s, want %s", test.name, &stats, &test.stats)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	ETHERTYPE_VLAN     = 0x8100
+	ETHERTYPE_QINQ     = 0x88a8
+	ETHERTYPE_QINQ_OLD = 0x9100
+	ETHERTYPE_MPLS     = 0x8847
+	ETHERTYPE_MPLS_MC  = 0x8848
+	ETHERTYPE_PPPOE    = 0x8864
+	ETHERTYPE_TEB      = 0x6558 // Transparent ethernet bridging, over GRE
+
+	VLAN_HLEN     = 4
+	MPLS_HLEN     = 4
+	PPPOE_HLEN    = 8 // Including the PPP protocol field
+	PPP_IP        = 0x0021
+	PPP_IP6       = 0x0057
+	GRE_MIN_HLEN  = 4
+	VXLAN_HLEN    = 8
+	GTPU_MIN_HLEN = 8
+	GTPU_G_PDU    = 0xff
+
+	VXLAN_PORT = 4789
+	GTPU_PORT  = 2152
+
+	IP_IPIP = 4
+	IP_IPV6 = 41
+	IP_GRE  = 47
+
+	// The most encapsulation headers stripped from a packet, so that crafted
+	// packets cannot keep the decoder busy.
+	MAX_ENCAP = 8
+)
+
+// Counts an encapsulation header, and fails once there are too many.
+func (p *Packet) encap() error {
+	p.depth++
+	if p.depth > MAX_ENCAP {
+		return fmt.Errorf("%w: more than %d encapsulations", ErrMalformed,
+			MAX_ENCAP)
+	}
+	return nil
+}
+
+// Decodes the ethernet frame at offset in data.
+func (p *Packet) decodeEthernet(data []byte, offset int) error {
+	if len(data) < offset+ETHER_HLEN {
+		return ErrTruncated
+	}
+	ethertype := binary.BigEndian.Uint16(data[offset+12 : offset+14])
+	return p.decodeEthertype(ethertype, data, offset+ETHER_HLEN)
+}
+
+// Strips any VLAN tags, MPLS labels and PPPoE session header from the packet
+// at offset in data, which has the given ethertype, and decodes the IP packet
+// inside. The first two VLAN IDs are recorded.
+func (p *Packet) decodeEthertype(ethertype uint16, data []byte,
+	offset int) error {
+	for {
+		if offset > len(data) {
+			return ErrTruncated
+		}
+		switch ethertype {
+		case ETHERTYPE_VLAN, ETHERTYPE_QINQ, ETHERTYPE_QINQ_OLD:
+			if err := p.encap(); err != nil {
+				return err
+			}
+			if len(data) < offset+VLAN_HLEN {
+				return ErrTruncated
+			}
+			id := binary.BigEndian.Uint16(data[offset:offset+2]) & 0x0fff
+			if p.VLAN == 0 {
+				p.VLAN = id
+			} else if p.InnerVLAN == 0 {
+				p.InnerVLAN = id
+			}
+			ethertype = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+			offset += VLAN_HLEN
+		case ETHERTYPE_MPLS, ETHERTYPE_MPLS_MC:
+			for bottom := false; !bottom; offset += MPLS_HLEN {
+				if err := p.encap(); err != nil {
+					return err
+				}
+				if len(data) < offset+MPLS_HLEN {
+					return ErrTruncated
+				}
+				bottom = data[offset+2]&0x01 != 0
+			}
+			if len(data) <= offset {
+				return ErrTruncated
+			}
+			// MPLS does not say what it carries, so go by the IP version.
+			switch data[offset] >> 4 {
+			case 4:
+				ethertype = ETHERTYPE_IP
+			case 6:
+				ethertype = ETHERTYPE_IP6
+			case 0:
+				// A pseudowire control word, followed by an ethernet frame.
+				return p.decodeEthernet(data, offset+4)
+			default:
+				return ErrUnsupported
+			}
+		case ETHERTYPE_PPPOE:
+			if err := p.encap(); err != nil {
+				return err
+			}
+			if len(data) < offset+PPPOE_HLEN {
+				return ErrTruncated
+			}
+			switch binary.BigEndian.Uint16(data[offset+6 : offset+8]) {
+			case PPP_IP:
+				ethertype = ETHERTYPE_IP
+			case PPP_IP6:
+				ethertype = ETHERTYPE_IP6
+			default:
+				return ErrUnsupported
+			}
+			offset += PPPOE_HLEN
+		default:
+			return p.decodeNetwork(ethertype, data, offset)
+		}
+	}
+}
+
+// Decodes the packet inside a tunnel, if the IP payload at offset in data is
+// one. IP in IP, GRE, VXLAN and GTP-U tunnels are understood, and the GRE key,
+// VXLAN network identifier or GTP-U tunnel endpoint identifier of the
+// innermost tunnel is recorded. Returns false if the payload is not a tunnel,
+// in which case it is to be decoded as it is.
+func (p *Packet) decodeTunnel(data []byte, offset int) (bool, error) {
+	payload := data[offset:]
+	switch p.Proto {
+	case IP_IPIP:
+		return true, p.decodeTunneled(ETHERTYPE_IP, data, offset)
+	case IP_IPV6:
+		return true, p.decodeTunneled(ETHERTYPE_IP6, data, offset)
+	case IP_GRE:
+		if len(payload) < GRE_MIN_HLEN {
+			return false, nil
+		}
+		flags := binary.BigEndian.Uint16(payload[0:2])
+		proto := binary.BigEndian.Uint16(payload[2:4])
+		if flags&0x0007 != 0 {
+			// Only version 0 carries packets we can decode.
+			return false, nil
+		}
+		hlen := GRE_MIN_HLEN
+		if flags&0x8000 != 0 {
+			hlen += 4 // Checksum
+		}
+		var key uint32
+		if flags&0x2000 != 0 {
+			if len(payload) < hlen+4 {
+				return true, ErrTruncated
+			}
+			key = binary.BigEndian.Uint32(payload[hlen : hlen+4])
+			hlen += 4
+		}
+		if flags&0x1000 != 0 {
+			hlen += 4 // Sequence number
+		}
+		if len(payload) < hlen {
+			return true, ErrTruncated
+		}
+		switch proto {
+		case ETHERTYPE_IP, ETHERTYPE_IP6, ETHERTYPE_MPLS, ETHERTYPE_MPLS_MC:
+			p.TunnelID = key
+			return true, p.decodeTunneled(proto, data, offset+hlen)
+		case ETHERTYPE_TEB:
+			p.TunnelID = key
+			if err := p.encap(); err != nil {
+				return true, err
+			}
+			return true, p.decodeEthernet(data, offset+hlen)
+		}
+	case IP_UDP:
+		if len(payload) < UDP_HLEN {
+			return false, nil
+		}
+		body := payload[UDP_HLEN:]
+		switch binary.BigEndian.Uint16(payload[2:4]) {
+		case VXLAN_PORT:
+			if len(body) < VXLAN_HLEN || body[0]&0x08 == 0 {
+				return false, nil
+			}
+			p.TunnelID = binary.BigEndian.Uint32(body[4:8]) >> 8
+			if err := p.encap(); err != nil {
+				return true, err
+			}
+			return true, p.decodeEthernet(data, offset+UDP_HLEN+VXLAN_HLEN)
+		case GTPU_PORT:
+			hlen, ok := gtpuHeaderLen(body)
+			if !ok || len(body) <= hlen {
+				// Signalling, such as echo requests, stays a UDP flow.
+				return false, nil
+			}
+			var ethertype uint16
+			switch body[hlen] >> 4 {
+			case 4:
+				ethertype = ETHERTYPE_IP
+			case 6:
+				ethertype = ETHERTYPE_IP6
+			default:
+				return false, nil
+			}
+			p.TunnelID = binary.BigEndian.Uint32(body[4:8])
+			return true, p.decodeTunneled(ethertype, data,
+				offset+UDP_HLEN+hlen)
+		}
+	}
+	return false, nil
+}
+
+// Decodes the packet with the given ethertype at offset in data, found inside
+// a tunnel.
+func (p *Packet) decodeTunneled(ethertype uint16, data []byte,
+	offset int) error {
+	if err := p.encap(); err != nil {
+		return err
+	}
+	return p.decodeEthertype(ethertype, data, offset)
+}
+
+// Returns the length of the GTP-U header at the start of data, including any
+// extension headers, if it is a version 1 header of a G-PDU (a message
+// carrying a user packet).
+func gtpuHeaderLen(data []byte) (int, bool) {
+	if len(data) < GTPU_MIN_HLEN {
+		return 0, false
+	}
+	flags := data[0]
+	if flags>>5 != 1 || flags&0x10 == 0 || data[1] != GTPU_G_PDU {
+		return 0, false
+	}
+	hlen := GTPU_MIN_HLEN
+	if flags&0x07 == 0 {
+		return hlen, true
+	}
+	// The sequence number, N-PDU number and next extension header type.
+	hlen += 4
+	if len(data) < hlen {
+		return 0, false
+	}
+	if flags&0x04 == 0 {
+		return hlen, true
+	}
+	for next := data[hlen-1]; next != 0; next = data[hlen-1] {
+		if len(data) <= hlen {
+			return 0, false
+		}
+		extlen := int(data[hlen]) * 4
+		if extlen == 0 || len(data) < hlen+extlen {
+			return 0, false
+		}
+		hlen += extlen
+	}
+	return hlen, true
+}
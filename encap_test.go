@@ -0,0 +1,67 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGre(t *testing.T) {
+	inner := ip4("10.1.0.1", "10.1.0.2", IP_UDP, udp(1111, 2222, 20))
+	gre := func(header ...[]byte) []byte {
+		return ether(ETHERTYPE_IP, ip4("192.168.0.1", "192.168.0.2", IP_GRE,
+			cat(header...)))
+	}
+	tests := []struct {
+		name   string
+		frame  []byte
+		err    error
+		tunnel uint32
+	}{
+		{"plain", gre(be16(0), be16(ETHERTYPE_IP), inner), nil, 0},
+		{"key", gre(be16(0x2000), be16(ETHERTYPE_IP), be32(42), inner), nil,
+			42},
+		{"checksum key sequence", gre(be16(0xb000), be16(ETHERTYPE_IP),
+			be32(0), be32(7), be32(1), inner), nil, 7},
+		// The optional fields are cut off at the end of the frame.
+		{"no checksum", gre(be16(0x8000), be16(ETHERTYPE_IP)), ErrTruncated,
+			0},
+		{"no sequence", gre(be16(0x9000), be16(ETHERTYPE_IP)), ErrTruncated,
+			0},
+		{"no key", gre(be16(0x2000), be16(ETHERTYPE_IP), be16(0)),
+			ErrTruncated, 0},
+		{"short sequence", gre(be16(0x3000), be16(ETHERTYPE_IP), be32(9),
+			be16(0)), ErrTruncated, 0},
+		{"empty", gre(be16(0), be16(ETHERTYPE_IP)), ErrTruncated, 0},
+	}
+	for _, test := range tests {
+		var p Packet
+		err := p.Decode(test.frame, time.Unix(1, 0))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && (p.SrcPort != 1111 || p.TunnelID != test.tunnel) {
+			t.Errorf("%s: decoded %+v", test.name, p)
+		}
+	}
+}
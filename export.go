@@ -0,0 +1,155 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// A single named value of an exported flow. Values are always one of int64,
+// float64 or string.
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// An exported flow, as a list of fields in column order.
+type Record []Field
+
+// Defines the functions needed to write out finished flows.
+type Exporter interface {
+	Export(rec Record) error // Write out a single flow
+	Flush() error            // Write out anything which has been buffered
+	Close() error            // Flush and finish the output
+}
+
+// Formats a field value for text output.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// Returns the names of the columns in a schema, in order.
+func columnNames(schema Record) []string {
+	columns := make([]string, len(schema))
+	for i, field := range schema {
+		columns[i] = field.Name
+	}
+	return columns
+}
+
+// Writes flows as comma separated values, one flow per line.
+type csvExporter struct {
+	w       *csv.Writer
+	columns []string
+	header  bool // Whether a header row still needs to be written
+	row     []string
+}
+
+// Creates an Exporter which writes comma separated values. If header is set,
+// the first row names the columns of schema.
+func NewCsvExporter(w io.Writer, schema Record, header bool) Exporter {
+	return &csvExporter{
+		w:       csv.NewWriter(w),
+		columns: columnNames(schema),
+		header:  header,
+	}
+}
+
+func (e *csvExporter) Export(rec Record) error {
+	if e.header {
+		e.header = false
+		if err := e.w.Write(e.columns); err != nil {
+			return err
+		}
+	}
+	e.row = e.row[:0]
+	for _, field := range rec {
+		e.row = append(e.row, formatValue(field.Value))
+	}
+	return e.w.Write(e.row)
+}
+
+func (e *csvExporter) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExporter) Close() error {
+	if e.header {
+		// No flows were exported, but the header was still asked for.
+		e.header = false
+		if err := e.w.Write(e.columns); err != nil {
+			return err
+		}
+	}
+	return e.Flush()
+}
+
+// Writes flows as JSON Lines: one JSON object per line, with the fields in
+// column order.
+type jsonExporter struct {
+	w *bufio.Writer
+}
+
+// Creates an Exporter which writes JSON Lines.
+func NewJsonExporter(w io.Writer) Exporter {
+	return &jsonExporter{w: bufio.NewWriter(w)}
+}
+
+func (e *jsonExporter) Export(rec Record) error {
+	e.w.WriteByte('{')
+	for i, field := range rec {
+		if i > 0 {
+			e.w.WriteByte(',')
+		}
+		name, _ := json.Marshal(field.Name)
+		e.w.Write(name)
+		e.w.WriteByte(':')
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", field.Name, err)
+		}
+		e.w.Write(value)
+	}
+	e.w.WriteByte('}')
+	_, err := e.w.WriteString("\n")
+	return err
+}
+
+func (e *jsonExporter) Flush() error {
+	return e.w.Flush()
+}
+
+func (e *jsonExporter) Close() error {
+	return e.Flush()
+}
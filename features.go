@@ -17,73 +17,197 @@
  *
  */
 
-package main
+package flowtbag
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// Converts a time value, given in microseconds, to an export unit which is
+// given in microseconds. Microseconds are exported as integers, and coarser
+// units as decimals so that no precision is lost.
+func timeValue(us float64, unit int64) interface{} {
+	if unit == 1 {
+		return int64(us)
+	}
+	return us / float64(unit)
+}
+
 // Defines the minimum set of functions needed for a Feature.
 type Feature interface {
-	Add(int64)      // Add a particular value to a feature
-	Export() string // Export the contents of a feature in string form
+	Add(int64)                 // Add a particular value to a feature
+	Export(name string) Record // Export the contents of a feature as fields
 	Get() int64
 	Set(int64) // Reset the feature to a particular value
 }
 
-// A feature which takes values and bins them according to their value.
-type BinFeature struct {
-	num_bins int   // The number of bins for this feature
-	bin_sep  int   // Ie. the magnitude of the range contained in each bin
-	bins     []int // Stores the actual count for each bin
+// How a HistogramFeature places values into bins. A Binning of n bins has n-1
+// boundaries in increasing order: values below the first boundary go in the
+// first bin, values at or above the last go in the last bin, and every other
+// value goes in the bin starting at the greatest boundary not above it. A
+// Binning made from bad arguments is reported by Config.Validate.
+type Binning struct {
+	bounds []float64
+	err    error // Why the arguments were bad, if they were
+}
+
+// Returns n bins of equal width spanning [min, max]. Values below min fall in
+// the first bin, and values above max in the last.
+func LinearBins(min float64, max float64, n int) Binning {
+	if n < 1 || !(max > min) {
+		return Binning{err: fmt.Errorf("bad linear bins: %d bins from %g to %g",
+			n, min, max)}
+	}
+	bounds := make([]float64, n-1)
+	width := (max - min) / float64(n)
+	for i := range bounds {
+		bounds[i] = tidy(min + width*float64(i+1))
+	}
+	return newBinning(bounds)
 }
 
-// Initializes the BinFeature to contain bins starting at min and going to max.
-// Anything below min is thrown into the lowest bin, and anything above max is
-// put in the last bin. num_bins is the number of bins required in the range
-// [min, max]
-func (f *BinFeature) Init(min int, max int, num_bins int) {
-	f.num_bins = num_bins - 1
-	diff := max - min
-	f.bin_sep = diff / f.num_bins
-	f.bins = make([]int, num_bins)
-	for i := 0; i < num_bins; i++ {
-		f.bins[i] = 0
+// Returns n bins spanning [min, max], each wider than the one before by the
+// same factor. min must be positive. Values below min fall in the first bin,
+// and values above max in the last.
+func LogBins(min float64, max float64, n int) Binning {
+	if n < 1 || !(min > 0) || !(max > min) {
+		return Binning{err: fmt.Errorf(
+			"bad logarithmic bins: %d bins from %g to %g", n, min, max)}
 	}
+	bounds := make([]float64, n-1)
+	ratio := math.Pow(max/min, 1/float64(n))
+	for i := range bounds {
+		bounds[i] = tidy(min * math.Pow(ratio, float64(i+1)))
+	}
+	return newBinning(bounds)
+}
+
+// Rounds away the error in a computed boundary, so that a boundary which
+// should be a round number, such as 1000, is.
+func tidy(bound float64) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(bound, 'g', 12, 64),
+		64)
+	return rounded
 }
 
-func (f *BinFeature) Add(val int64) {
-	bin := MinInt(int(val)/f.bin_sep, f.num_bins)
-	f.bins[bin] += 1
+// Returns the bins between the given boundaries, which must be increasing,
+// plus one bin below the first and one from the last up.
+func EdgeBins(bounds ...float64) Binning {
+	return newBinning(append([]float64(nil), bounds...))
 }
 
-func (f *BinFeature) Export() string {
-	ret := ""
-	for i := 0; i < len(f.bins); i++ {
-		if i > 0 {
-			ret += fmt.Sprintf(",")
+// Returns the bins between bounds, or a Binning holding an error if they are
+// not finite and increasing.
+func newBinning(bounds []float64) Binning {
+	for i, bound := range bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) ||
+			(i > 0 && bound <= bounds[i-1]) {
+			return Binning{err: fmt.Errorf(
+				"bad bin edges: %v is not finite and increasing", bounds)}
 		}
-		ret += fmt.Sprintf("%d", f.bins[i])
+	}
+	return Binning{bounds: bounds}
+}
+
+// Returns the number of bins.
+func (b Binning) Len() int {
+	return len(b.bounds) + 1
+}
+
+// Returns the bin a value falls in.
+func (b Binning) bin(val float64) int {
+	return sort.Search(len(b.bounds), func(i int) bool {
+		return b.bounds[i] > val
+	})
+}
+
+// Returns the name of the column counting a bin of a histogram: the feature
+// name, then lt and the upper boundary for the first bin, or ge and the lower
+// boundary for the others, as in fpktl_hist_lt_64 and fpktl_hist_ge_64. A
+// decimal point in a boundary is written as p, and a minus sign as m, so that
+// 0.5 gives ge_0p5. A histogram of a single bin has the column name_all.
+func (b Binning) column(name string, i int) string {
+	if len(b.bounds) == 0 {
+		return name + "_all"
+	}
+	op, bound := "ge", 0.0
+	if i == 0 {
+		op, bound = "lt", b.bounds[0]
+	} else {
+		bound = b.bounds[i-1]
+	}
+	return fmt.Sprintf("%s_%s_%s", name, op, binName.Replace(
+		strconv.FormatFloat(bound, 'f', -1, 64)))
+}
+
+// Makes a boundary fit in a column name.
+var binName = strings.NewReplacer(".", "p", "-", "m")
+
+// A feature which counts the values added to it in bins. It is exported as
+// one column per bin, named after the feature and the range of the bin.
+type HistogramFeature struct {
+	bins   Binning
+	counts []int64
+}
+
+// Creates a HistogramFeature with the given bins, all empty.
+func NewHistogramFeature(bins Binning) *HistogramFeature {
+	return &HistogramFeature{bins: bins, counts: make([]int64, bins.Len())}
+}
+
+func (f *HistogramFeature) Add(val int64) {
+	f.counts[f.bins.bin(float64(val))]++
+}
+
+func (f *HistogramFeature) Export(name string) Record {
+	ret := make(Record, len(f.counts))
+	for i, count := range f.counts {
+		ret[i] = Field{f.bins.column(name, i), count}
 	}
 	return ret
 }
 
-func (f *BinFeature) Get() int64 {
-	return int64(f.bins[0])
+// Returns the number of values added.
+func (f *HistogramFeature) Get() int64 {
+	var total int64
+	for _, count := range f.counts {
+		total += count
+	}
+	return total
 }
 
-func (f *BinFeature) Set(val int64) {
-	for i := 0; i < len(f.bins); i++ {
-		f.bins[i] = int(val)
+// Empties the histogram, then adds val as its single value.
+func (f *HistogramFeature) Set(val int64) {
+	for i := range f.counts {
+		f.counts[i] = 0
 	}
+	f.Add(val)
 }
 
+// A feature which summarises the distribution of the values added to it. The
+// moments are kept with Welford's streaming method, which stays accurate where
+// sums of squares would lose precision, and every statistic is exported as a
+// decimal: the minimum, mean, maximum, sample standard deviation and variance,
+// skewness, excess kurtosis, and coefficient of variation (the standard
+// deviation over the mean). Statistics which are undefined for the values
+// added are exported as zero: all of them without values, the standard
+// deviation and variance of a single value, the skewness and kurtosis of
+// values which are all equal, and the coefficient of variation of values with
+// a mean of zero.
 type DistributionFeature struct {
-	sum   int64
-	sumsq int64
 	count int64
+	mean  float64
+	m2    float64 // Sums of the second to fourth powers of the distance from
+	m3    float64 // the mean
+	m4    float64
 	min   int64
 	max   int64
+	init  bool  // Whether any values have been added
+	unit  int64 // For times, the export unit in microseconds. Zero otherwise.
 }
 
 func (f *DistributionFeature) Init(val int64) {
@@ -91,27 +215,56 @@ func (f *DistributionFeature) Init(val int64) {
 }
 
 func (f *DistributionFeature) Add(val int64) {
-	f.sum += val
-	f.sumsq += val * val
-	f.count++
-	if (val < f.min) || (f.min == 0) {
+	if !f.init || val < f.min {
 		f.min = val
 	}
-	if val > f.max {
+	if !f.init || val > f.max {
 		f.max = val
 	}
+	f.init = true
+	n1 := float64(f.count)
+	f.count++
+	n := float64(f.count)
+	delta := float64(val) - f.mean
+	deltaN := delta / n
+	deltaN2 := deltaN * deltaN
+	term := delta * deltaN * n1
+	f.mean += deltaN
+	f.m4 += term*deltaN2*(n*n-3*n+3) + 6*deltaN2*f.m2 - 4*deltaN*f.m3
+	f.m3 += term*deltaN*(n-2) - 3*deltaN*f.m2
+	f.m2 += term
 }
 
-func (f *DistributionFeature) Export() string {
-	var (
-		stdDev int64 = 0
-		mean   int64 = 0
-	)
-	if f.count > 0 {
-		stdDev = int64(stddev(float64(f.sumsq), float64(f.sum), f.count))
-		mean = f.sum / f.count
+func (f *DistributionFeature) Export(name string) Record {
+	var variance, stdDev, skew, kurt, cv float64
+	if f.count > 1 {
+		variance = f.m2 / float64(f.count-1)
+		stdDev = math.Sqrt(variance)
+	}
+	if f.m2 > 0 {
+		n := float64(f.count)
+		skew = math.Sqrt(n) * f.m3 / math.Pow(f.m2, 1.5)
+		kurt = n*f.m4/(f.m2*f.m2) - 3
+	}
+	if f.mean != 0 {
+		cv = stdDev / f.mean
+	}
+	// Times are scaled to the export unit. The shape of the distribution
+	// does not depend on the unit.
+	scale := 1.0
+	if f.unit > 0 {
+		scale = float64(f.unit)
+	}
+	return Record{
+		{"min_" + name, float64(f.min) / scale},
+		{"mean_" + name, f.mean / scale},
+		{"max_" + name, float64(f.max) / scale},
+		{"std_" + name, stdDev / scale},
+		{"var_" + name, variance / (scale * scale)},
+		{"skew_" + name, skew},
+		{"kurt_" + name, kurt},
+		{"cv_" + name, cv},
 	}
-	return fmt.Sprintf("%d,%d,%d,%d", f.min, mean, f.max, stdDev)
 }
 
 func (f *DistributionFeature) Get() int64 {
@@ -120,15 +273,70 @@ func (f *DistributionFeature) Get() int64 {
 
 // Set the DistributionFeature to include val as the single value in the Feature.
 func (f *DistributionFeature) Set(val int64) {
-	f.sum = val
-	f.sumsq = val * val
-	f.count = val
-	f.min = val
-	f.max = val
+	*f = DistributionFeature{unit: f.unit}
+	f.Add(val)
+}
+
+// The quantiles exported by a QuantileFeature, with their column prefixes.
+var QUANTILES = []struct {
+	prefix string
+	q      float64
+}{
+	{"median_", 0.5},
+	{"p90_", 0.9},
+	{"p99_", 0.99},
+}
+
+// A DistributionFeature which also estimates the quantiles of its values with
+// a DDSketch, and exports the median, 90th and 99th percentiles after the
+// other statistics. The estimates are within SKETCH_ACCURACY of a value in the
+// flow, and never beyond its minimum or maximum.
+type QuantileFeature struct {
+	DistributionFeature
+	sketch *DDSketch
+}
+
+func NewQuantileFeature(unit int64) *QuantileFeature {
+	return &QuantileFeature{
+		DistributionFeature: DistributionFeature{unit: unit},
+		sketch:              NewDDSketch(SKETCH_ACCURACY),
+	}
+}
+
+func (f *QuantileFeature) Init(val int64) {
+	f.Set(val)
+}
+
+func (f *QuantileFeature) Add(val int64) {
+	f.DistributionFeature.Add(val)
+	f.sketch.Add(float64(val))
+}
+
+func (f *QuantileFeature) Export(name string) Record {
+	rec := f.DistributionFeature.Export(name)
+	scale := 1.0
+	if f.unit > 0 {
+		scale = float64(f.unit)
+	}
+	for _, q := range QUANTILES {
+		est := f.sketch.Quantile(q.q)
+		est = math.Max(est, float64(f.min))
+		est = math.Min(est, float64(f.max))
+		rec = append(rec, Field{q.prefix + name, est / scale})
+	}
+	return rec
+}
+
+// Set the QuantileFeature to include val as the single value in the Feature.
+func (f *QuantileFeature) Set(val int64) {
+	f.DistributionFeature.Set(val)
+	f.sketch.Reset()
+	f.sketch.Add(float64(val))
 }
 
 type ValueFeature struct {
 	value int64
+	unit  int64 // For times, the export unit in microseconds. Zero otherwise.
 }
 
 func (f *ValueFeature) Init(val int64) {
@@ -139,8 +347,11 @@ func (f *ValueFeature) Add(val int64) {
 	f.value += val
 }
 
-func (f *ValueFeature) Export() string {
-	return fmt.Sprintf("%d", f.value)
+func (f *ValueFeature) Export(name string) Record {
+	if f.unit > 0 {
+		return Record{{name, timeValue(float64(f.value), f.unit)}}
+	}
+	return Record{{name, f.value}}
 }
 
 func (f *ValueFeature) Get() int64 {
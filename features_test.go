@@ -0,0 +1,110 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDistribution(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int64
+		unit   int64
+		// min, mean, max, std, var, skew, kurt and cv
+		want [8]float64
+	}{
+		{"empty", nil, 0, [8]float64{}},
+		{"one value", []int64{5}, 0, [8]float64{5, 5, 5, 0, 0, 0, 0, 0}},
+		{"two values", []int64{1, 3}, 0,
+			[8]float64{1, 2, 3, math.Sqrt2, 2, 0, -2, math.Sqrt2 / 2}},
+		{"zero variance", []int64{7, 7, 7, 7}, 0,
+			[8]float64{7, 7, 7, 0, 0, 0, 0, 0}},
+		{"zeros", []int64{0, 0, 0}, 0, [8]float64{}},
+		{"mean zero", []int64{-2, 2}, 0,
+			[8]float64{-2, 0, 2, math.Sqrt(8), 8, 0, -2, 0}},
+		{"skewed", []int64{1, 1, 1, 5}, 0,
+			[8]float64{1, 2, 5, 2, 4, 2 * math.Sqrt(3) / 3, -2.0 / 3, 1}},
+		// Times in microseconds, exported in milliseconds.
+		{"milliseconds", []int64{1000, 3000}, 1000,
+			[8]float64{1, 2, 3, math.Sqrt2, 2, 0, -2, math.Sqrt2 / 2}},
+	}
+	for _, test := range tests {
+		f := DistributionFeature{unit: test.unit}
+		for _, v := range test.values {
+			f.Add(v)
+		}
+		rec := f.Export("x")
+		if len(rec) != len(test.want) {
+			t.Fatalf("%s: exported %d fields", test.name, len(rec))
+		}
+		for i, field := range rec {
+			v, ok := field.Value.(float64)
+			if !ok || math.IsNaN(v) || math.IsInf(v, 0) ||
+				math.Abs(v-test.want[i]) > 1e-9 {
+				t.Errorf("%s: %s is %v, want %v", test.name, field.Name,
+					field.Value, test.want[i])
+			}
+		}
+	}
+}
+
+// Set starts the distribution afresh from a single value.
+func TestDistributionSet(t *testing.T) {
+	f := DistributionFeature{unit: 1000}
+	for _, v := range []int64{1000, 9000, 4000} {
+		f.Add(v)
+	}
+	f.Set(2000)
+	want := []float64{2, 2, 2, 0, 0, 0, 0, 0}
+	for i, field := range f.Export("x") {
+		if field.Value != want[i] {
+			t.Errorf("%s is %v, want %v", field.Name, field.Value, want[i])
+		}
+	}
+	if f.Get() != 1 {
+		t.Errorf("got a count of %d", f.Get())
+	}
+}
+
+// The columns of a histogram are named after the ranges of their bins.
+func TestHistogramColumns(t *testing.T) {
+	tests := []struct {
+		bins Binning
+		want []string
+	}{
+		{EdgeBins(64, 1024), []string{"x_lt_64", "x_ge_64", "x_ge_1024"}},
+		{LogBins(10, 10000000, 2), []string{"x_lt_10000", "x_ge_10000"}},
+		{LinearBins(-1, 1, 4), []string{"x_lt_m0p5", "x_ge_m0p5", "x_ge_0",
+			"x_ge_0p5"}},
+		{EdgeBins(), []string{"x_all"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, field := range NewHistogramFeature(test.bins).Export("x") {
+			got = append(got, field.Name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("got %v, want %v", got, test.want)
+		}
+	}
+}
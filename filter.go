@@ -0,0 +1,509 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The error wrapped by every error ParseFilter gives.
+var ErrFilter = errors.New("invalid filter")
+
+// The IP protocols which can be named in a filter.
+var filterProtocols = map[string]uint8{
+	"icmp":  IP_ICMP,
+	"igmp":  2,
+	"tcp":   IP_TCP,
+	"udp":   IP_UDP,
+	"gre":   IP_GRE,
+	"esp":   50,
+	"ah":    51,
+	"icmp6": IP_ICMP6,
+	"sctp":  IP_SCTP,
+}
+
+// A filter on decoded packets, written in the syntax of pcap filters
+// (see pcap-filter(7)). The following primitives are understood, and may be
+// combined with and (&&), or (||), not (!) and parentheses:
+//
+//	[src|dst] host <address>
+//	[src|dst] net <address>[/<prefix length>]
+//	[src|dst] port <number or service name>
+//	[src|dst] portrange <low>-<high>
+//	[ip|ip6] proto <number or name>
+//	ip, ip6, tcp, udp, sctp, icmp, icmp6
+//	vlan [<id>]
+//	less <length>, greater <length>
+//
+// A host, net, port or portrange may be preceded by a protocol (such as tcp
+// in "tcp port 80"), which must also match. As in pcap, and and or have the
+// same precedence, and a value given without a keyword takes those of the
+// primitive before it, so "port 80 or 443" is "port 80 or port 443".
+//
+// Other primitives, such as ether and arp, and accesses to packet data, such
+// as tcp[13], are errors.
+//
+// Filters apply to the innermost packet, once VLAN tags and tunnels have been
+// stripped and fragments reassembled. Lengths are those of the IP packet.
+type Filter struct {
+	expr  string
+	match func(p *Packet) bool
+}
+
+// Returns the expression the filter was parsed from.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Returns whether the packet passes the filter. A nil Filter passes every
+// packet.
+func (f *Filter) Match(p *Packet) bool {
+	return f == nil || f.match(p)
+}
+
+// Parses a filter expression. An empty expression passes every packet.
+func ParseFilter(expr string) (*Filter, error) {
+	fp := &filterParser{tokens: tokenizeFilter(expr)}
+	if len(fp.tokens) == 0 {
+		return &Filter{expr: expr, match: func(*Packet) bool { return true }},
+			nil
+	}
+	match, err := fp.expr()
+	if err == nil && fp.pos < len(fp.tokens) {
+		err = fp.unexpected(fp.tokens[fp.pos])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{expr: expr, match: match}, nil
+}
+
+// Splits a filter expression into words, parentheses and operators.
+func tokenizeFilter(expr string) []string {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, expr[i:i+1])
+			i++
+		case strings.HasPrefix(expr[i:], "&&"),
+			strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		default:
+			j := i
+			for j < len(expr) &&
+				!strings.ContainsRune(" \t\n()!&|", rune(expr[j])) {
+				j++
+			}
+			if j == i {
+				// A lone & or |.
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+// The keywords of the primitive last parsed, which a bare value takes on.
+type filterQualifiers struct {
+	proto string // ip, ip6, tcp and so on, if any
+	dir   string // src or dst, if any
+	kind  string // host, net, port, portrange or proto
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+	last   *filterQualifiers
+}
+
+func (fp *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrFilter, fmt.Sprintf(format, args...))
+}
+
+// Returns the next token without taking it, or "" at the end.
+func (fp *filterParser) peek() string {
+	if fp.pos < len(fp.tokens) {
+		return fp.tokens[fp.pos]
+	}
+	return ""
+}
+
+func (fp *filterParser) next() string {
+	token := fp.peek()
+	if token != "" {
+		fp.pos++
+	}
+	return token
+}
+
+// Parses primitives joined by and and or, from left to right.
+func (fp *filterParser) expr() (func(*Packet) bool, error) {
+	left, err := fp.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch fp.peek() {
+		case "and", "&&":
+			fp.next()
+			right, err := fp.unary()
+			if err != nil {
+				return nil, err
+			}
+			l := left
+			left = func(p *Packet) bool { return l(p) && right(p) }
+		case "or", "||":
+			fp.next()
+			right, err := fp.unary()
+			if err != nil {
+				return nil, err
+			}
+			l := left
+			left = func(p *Packet) bool { return l(p) || right(p) }
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (fp *filterParser) unary() (func(*Packet) bool, error) {
+	switch fp.peek() {
+	case "not", "!":
+		fp.next()
+		inner, err := fp.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(p *Packet) bool { return !inner(p) }, nil
+	case "(":
+		fp.next()
+		inner, err := fp.expr()
+		if err != nil {
+			return nil, err
+		}
+		if fp.next() != ")" {
+			return nil, fp.errorf("missing )")
+		}
+		return inner, nil
+	case "":
+		return nil, fp.errorf("unexpected end of expression")
+	}
+	return fp.primitive()
+}
+
+// The keywords of pcap-filter(7) which Filter does not support.
+var unsupportedFilterWords = map[string]bool{
+	"ether": true, "arp": true, "rarp": true, "link": true, "ppp": true,
+	"slip": true, "fddi": true, "tr": true, "wlan": true, "type": true,
+	"subtype": true, "dir": true, "gateway": true, "broadcast": true,
+	"multicast": true, "len": true, "protochain": true, "mpls": true,
+	"pppoed": true, "pppoes": true, "geneve": true, "inbound": true,
+	"outbound": true, "ifname": true, "on": true, "atalk": true, "aarp": true,
+	"decnet": true, "iso": true, "stp": true, "ipx": true, "netbeui": true,
+}
+
+// Returns the error for a word which cannot come where it does, naming the
+// pcap-filter(7) features which are not supported.
+func (fp *filterParser) unexpected(word string) error {
+	switch {
+	case unsupportedFilterWords[word]:
+		return fp.errorf("unsupported primitive %q", word)
+	case strings.ContainsAny(word, "[]"):
+		return fp.errorf("unsupported packet data access %q", word)
+	}
+	return fp.errorf("unexpected %q", word)
+}
+
+// Returns whether a word is a keyword rather than a value.
+func isFilterKeyword(word string) bool {
+	switch word {
+	case "ip", "ip6", "tcp", "udp", "sctp", "icmp", "icmp6", "src", "dst",
+		"host", "net", "port", "portrange", "proto", "vlan", "less",
+		"greater", "and", "or", "not", "(", ")", "!", "&&", "||":
+		return true
+	}
+	return false
+}
+
+// Returns whether a word ends a primitive.
+func endsPrimitive(word string) bool {
+	switch word {
+	case "", "and", "or", "&&", "||", ")":
+		return true
+	}
+	return false
+}
+
+func (fp *filterParser) primitive() (func(*Packet) bool, error) {
+	switch word := fp.peek(); word {
+	case "vlan":
+		fp.next()
+		if endsPrimitive(fp.peek()) {
+			return func(p *Packet) bool { return p.VLAN != 0 }, nil
+		}
+		id, err := fp.number(fp.next(), 4095)
+		if err != nil {
+			return nil, err
+		}
+		return func(p *Packet) bool {
+			return p.VLAN != 0 && (p.VLAN == uint16(id) ||
+				p.InnerVLAN == uint16(id))
+		}, nil
+	case "less", "greater":
+		fp.next()
+		length, err := fp.number(fp.next(), MAX_DATAGRAM)
+		if err != nil {
+			return nil, err
+		}
+		if word == "less" {
+			return func(p *Packet) bool { return p.Len <= int64(length) }, nil
+		}
+		return func(p *Packet) bool { return p.Len >= int64(length) }, nil
+	}
+	var q filterQualifiers
+	if !isFilterKeyword(fp.peek()) {
+		// A bare value takes the keywords of the primitive before it.
+		switch {
+		case unsupportedFilterWords[fp.peek()] ||
+			strings.ContainsAny(fp.peek(), "[]"):
+			return nil, fp.unexpected(fp.peek())
+		case fp.last != nil:
+			q = *fp.last
+		case net.ParseIP(fp.peek()) != nil:
+			q.kind = "host"
+		default:
+			return nil, fp.errorf("%q needs a keyword such as host or port",
+				fp.peek())
+		}
+	} else {
+		switch fp.peek() {
+		case "ip", "ip6", "tcp", "udp", "sctp", "icmp", "icmp6":
+			q.proto = fp.next()
+		}
+		switch fp.peek() {
+		case "src", "dst":
+			q.dir = fp.next()
+		}
+		switch fp.peek() {
+		case "host", "net", "port", "portrange", "proto":
+			q.kind = fp.next()
+		}
+		if q.kind == "" {
+			if q.dir == "" {
+				// Just a protocol, such as "tcp".
+				if q.proto == "" {
+					return nil, fp.unexpected(fp.peek())
+				}
+				return protocolMatch(q.proto), nil
+			}
+			q.kind = "host"
+		}
+	}
+	value := fp.next()
+	if endsPrimitive(value) || isFilterKeyword(value) {
+		return nil, fp.errorf("missing value after %q", q.kind)
+	}
+	match, err := fp.qualified(q, value)
+	if err != nil {
+		return nil, err
+	}
+	fp.last = &q
+	if q.proto != "" {
+		proto := protocolMatch(q.proto)
+		inner := match
+		match = func(p *Packet) bool { return proto(p) && inner(p) }
+	}
+	return match, nil
+}
+
+// Returns a match on the protocol named by a protocol keyword.
+func protocolMatch(name string) func(*Packet) bool {
+	switch name {
+	case "ip":
+		return func(p *Packet) bool { return p.SrcIP.Is4() }
+	case "ip6":
+		return func(p *Packet) bool { return !p.SrcIP.Is4() }
+	}
+	proto := filterProtocols[name]
+	return func(p *Packet) bool { return p.Proto == proto }
+}
+
+// Builds the match of a host, net, port, portrange or proto primitive.
+func (fp *filterParser) qualified(q filterQualifiers,
+	value string) (func(*Packet) bool, error) {
+	switch q.kind {
+	case "host", "net":
+		var prefix Addr
+		bits := 128
+		addr := value
+		if q.kind == "net" {
+			if i := strings.IndexByte(value, '/'); i >= 0 {
+				addr = value[:i]
+				n, err := strconv.Atoi(value[i+1:])
+				if err != nil || n < 0 {
+					return nil, fp.errorf("bad prefix length in %q", value)
+				}
+				bits = n
+			}
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fp.errorf("%q is not an IP address", addr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			prefix = addr4(ip4)
+			if bits == 128 {
+				bits = 32
+			}
+			if bits > 32 {
+				return nil, fp.errorf("bad prefix length in %q", value)
+			}
+			bits += 96
+		} else {
+			copy(prefix[:], ip)
+			if bits > 128 {
+				return nil, fp.errorf("bad prefix length in %q", value)
+			}
+		}
+		var mask Addr
+		for i := 0; i < bits; i++ {
+			mask[i/8] |= 0x80 >> uint(i%8)
+		}
+		for i := range prefix {
+			prefix[i] &= mask[i]
+		}
+		in := func(a Addr) bool {
+			for i := range a {
+				if a[i]&mask[i] != prefix[i] {
+					return false
+				}
+			}
+			return true
+		}
+		return directed(q.dir,
+			func(p *Packet) bool { return in(p.SrcIP) },
+			func(p *Packet) bool { return in(p.DstIP) }), nil
+	case "port", "portrange":
+		low, high, err := fp.ports(q, value)
+		if err != nil {
+			return nil, err
+		}
+		in := func(port uint16) bool { return port >= low && port <= high }
+		src := func(p *Packet) bool { return hasPorts(p) && in(p.SrcPort) }
+		dst := func(p *Packet) bool { return hasPorts(p) && in(p.DstPort) }
+		return directed(q.dir, src, dst), nil
+	case "proto":
+		if q.dir != "" {
+			return nil, fp.errorf("proto cannot be given %s", q.dir)
+		}
+		name := strings.TrimPrefix(value, "\\")
+		proto, ok := filterProtocols[name]
+		if !ok {
+			n, err := fp.number(name, 255)
+			if err != nil {
+				return nil, err
+			}
+			proto = uint8(n)
+		}
+		return func(p *Packet) bool { return p.Proto == proto }, nil
+	}
+	return nil, fp.errorf("unknown primitive %q", q.kind)
+}
+
+// Combines matches on the source and destination as a direction qualifier
+// asks.
+func directed(dir string, src, dst func(*Packet) bool) func(*Packet) bool {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+	return func(p *Packet) bool { return src(p) || dst(p) }
+}
+
+// Returns whether the ports of a packet are real ports.
+func hasPorts(p *Packet) bool {
+	return p.Proto == IP_TCP || p.Proto == IP_UDP || p.Proto == IP_SCTP
+}
+
+// Parses the value of a port or portrange primitive.
+func (fp *filterParser) ports(q filterQualifiers,
+	value string) (uint16, uint16, error) {
+	if q.kind == "port" {
+		port, err := fp.port(q.proto, value)
+		return port, port, err
+	}
+	i := strings.IndexByte(value, '-')
+	if i < 0 {
+		return 0, 0, fp.errorf("portrange %q is not of the form low-high",
+			value)
+	}
+	low, err := fp.port(q.proto, value[:i])
+	if err != nil {
+		return 0, 0, err
+	}
+	high, err := fp.port(q.proto, value[i+1:])
+	if err != nil {
+		return 0, 0, err
+	}
+	if low > high {
+		low, high = high, low
+	}
+	return low, high, nil
+}
+
+// Parses a port number or service name.
+func (fp *filterParser) port(proto string, value string) (uint16, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 0 || n > 65535 {
+			return 0, fp.errorf("port %d out of range", n)
+		}
+		return uint16(n), nil
+	}
+	network := "tcp"
+	if proto == "udp" {
+		network = "udp"
+	}
+	n, err := net.LookupPort(network, value)
+	if err != nil {
+		return 0, fp.errorf("unknown port %q", value)
+	}
+	return uint16(n), nil
+}
+
+// Parses a number no greater than max.
+func (fp *filterParser) number(value string, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > max {
+		return 0, fp.errorf("%q is not a number from 0 to %d", value, max)
+	}
+	return n, nil
+}
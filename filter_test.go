@@ -0,0 +1,133 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// Returns a decoded packet of 100 bytes with the given addresses and ports.
+func filterPacket(src, dst string, proto uint8, sport, dport uint16) *Packet {
+	p := &Packet{Proto: proto, SrcPort: sport, DstPort: dport, Len: 100}
+	if ip := net.ParseIP(src).To4(); ip != nil {
+		p.SrcIP, p.DstIP = addr4(ip), addr4(net.ParseIP(dst).To4())
+	} else {
+		copy(p.SrcIP[:], net.ParseIP(src))
+		copy(p.DstIP[:], net.ParseIP(dst))
+	}
+	return p
+}
+
+func TestFilter(t *testing.T) {
+	a := filterPacket("10.1.2.3", "192.168.0.1", IP_TCP, 1234, 80)
+	b := filterPacket("2001:db8::1", "2001:db8::2", IP_UDP, 53, 5353)
+	c := filterPacket("10.9.9.9", "10.1.2.3", IP_ICMP, 7, 0x0800)
+	c.VLAN = 100
+	tests := []struct {
+		expr    string
+		a, b, c bool
+	}{
+		{"", true, true, true},
+		{"tcp", true, false, false},
+		{"ip", true, false, true},
+		{"ip6", false, true, false},
+		{"host 10.1.2.3", true, false, true},
+		{"src host 10.1.2.3", true, false, false},
+		{"dst 10.1.2.3", false, false, true},
+		{"10.9.9.9", false, false, true},
+		{"net 10.0.0.0/8", true, false, true},
+		{"src net 10.1.0.0/16", true, false, false},
+		{"dst net 192.168.0.0/24", true, false, false},
+		{"net 2001:db8::/32", false, true, false},
+		{"port 80", true, false, false},
+		{"port http", true, false, false},
+		{"port 80 or 53", true, true, false},
+		{"tcp port 80 or 53", true, false, false},
+		{"portrange 50-60", false, true, false},
+		{"dst portrange 5000-6000", false, true, false},
+		{"tcp portrange 1-1000", true, false, false},
+		{"proto 17", false, true, false},
+		{"ip proto \\tcp", true, false, false},
+		{"vlan", false, false, true},
+		{"vlan 100", false, false, true},
+		{"vlan 101", false, false, false},
+		{"less 100", true, true, true},
+		{"greater 101", false, false, false},
+		// Negation binds tighter than and and or.
+		{"not tcp", false, true, true},
+		{"not tcp and not udp", false, false, true},
+		{"!tcp&&!udp", false, false, true},
+		{"not (tcp or udp)", false, false, true},
+		{"not not tcp", true, false, false},
+		// And and or have the same precedence, and apply from left to right.
+		{"tcp or udp and port 53", false, true, false},
+		{"tcp or (udp and port 53)", true, true, false},
+		{"udp and port 53 or tcp", true, true, false},
+		{"icmp or udp and src port 53", false, true, false},
+		{"icmp or (udp and src port 53)", false, true, true},
+	}
+	for _, test := range tests {
+		f, err := ParseFilter(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		if f.Match(a) != test.a || f.Match(b) != test.b ||
+			f.Match(c) != test.c {
+			t.Errorf("%q: got %v %v %v, want %v %v %v", test.expr, f.Match(a),
+				f.Match(b), f.Match(c), test.a, test.b, test.c)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"ether host 00:11:22:33:44:55", `unsupported primitive "ether"`},
+		{"arp", `unsupported primitive "arp"`},
+		{"tcp or gateway 10.0.0.1", `unsupported primitive "gateway"`},
+		{"port 80 or mpls", `unsupported primitive "mpls"`},
+		{"ip broadcast", `unsupported primitive "broadcast"`},
+		{"tcp[13] & 2 != 0", `unsupported packet data access "tcp[13]"`},
+		{"frobnicate", `"frobnicate" needs a keyword such as host or port`},
+		{"host", `missing value after "host"`},
+		{"host example.com", `"example.com" is not an IP address`},
+		{"port 70000", "port 70000 out of range"},
+		{"portrange 5", `portrange "5" is not of the form low-high`},
+		{"net 10.0.0.0/33", `bad prefix length in "10.0.0.0/33"`},
+		{"src proto 6", "proto cannot be given src"},
+		{"vlan 5000", `"5000" is not a number from 0 to 4095`},
+		{"(tcp", "missing )"},
+		{"tcp)", `unexpected ")"`},
+		{"tcp and", "unexpected end of expression"},
+		{"tcp or or udp", `unexpected "or"`},
+	}
+	for _, test := range tests {
+		_, err := ParseFilter(test.expr)
+		if !errors.Is(err, ErrFilter) ||
+			err.Error() != ErrFilter.Error()+": "+test.err {
+			t.Errorf("%q: got %v, want %s", test.expr, err, test.err)
+		}
+	}
+}
@@ -17,66 +17,32 @@
  *
  */
 
-package main
+package flowtbag
 
 import (
 	"fmt"
-	"log"
 )
 
 const (
-	IP_TCP = 6
-	IP_UDP = 17
+	IP_ICMP  = 1
+	IP_TCP   = 6
+	IP_UDP   = 17
+	IP_ICMP6 = 58
+	IP_SCTP  = 132
 
 	P_FORWARD  = 0
 	P_BACKWARD = 1
 
-	ADD_SUCCESS = 0
-	ADD_CLOSED  = 1
-	ADD_IDLE    = 2
-)
-
-const (
-	// Configurables. These should at some point be read in from a configuration
-	// file.
-	FLOW_TIMEOUT   = 600000000
-	IDLE_THRESHOLD = 1000000
-)
-
-// This is how we represent each packet after it is decoded. A simple map from the
-// string value for it's name to the value
-type packet map[string]int64
-
-const (
-	// To add new features, add the name here, then initialize the
-	// value in init(), and calculate it in add(). You can finalize it
-	// in Export()
-	TOTAL_FPACKETS = iota
-	TOTAL_FVOLUME
-	TOTAL_BPACKETS
-	TOTAL_BVOLUME
-	FPKTL
-	BPKTL
-	FIAT
-	BIAT
-	DURATION
-	ACTIVE
-	IDLE
-	SFLOW_FPACKETS
-	SFLOW_FBYTES
-	SFLOW_BPACKETS
-	SFLOW_BBYTES
-	FPSH_CNT
-	BPSH_CNT
-	FURG_CNT
-	BURG_CNT
-	TOTAL_FHLEN
-	TOTAL_BHLEN
-	NUM_FEATURES // Not a real feature. Just the total number of features.
+	ADD_SUCCESS   = 0
+	ADD_CLOSED    = 1
+	ADD_IDLE      = 2
+	ADD_REORDERED = 3 // The packet was earlier than the last of the flow
 )
 
 type Flow struct {
-	f []Feature // A map of the features to be exported
+	f      []Feature      // The features, in the order of the registry
+	layout *featureLayout // Which features are computed and exported
+	cfg    *Config        // Settings of the table the flow belongs to
 
 	valid       bool     // Has the flow met the requirements of a bi-directional flow
 	activeStart int64    // The starting time of the latest activity
@@ -88,92 +54,96 @@ type Flow struct {
 	hasData     bool     // Whether the connection has had any data transmitted.
 	isBidir     bool     // Is the flow bi-directional?
 	pdir        int8     // Direction of the current packet
-	srcip       string   // IP address of the source (client)
+	srcip       Addr     // IP address of the source (client)
 	srcport     uint16   // Port number of the source connection
-	dstip       string   // IP address of the destination (server)
+	dstip       Addr     // IP address of the destination (server)
 	dstport     uint16   // Port number of the destionation connection.
 	proto       uint8    // The IP protocol being used for the connection.
-	dscp        uint8    // The first set DSCP field for the flow.
+
+	// The packet being added, as the features see it
+	iat    int64 // The time since the previous packet in its direction, or -1
+	idle   int64 // The idle time the packet ended, or 0
+	active int64 // The active time before that idle time
+
+	// The VLANs and tunnel the flow was found in
+	vlan      uint16
+	innerVlan uint16
+	tunnelID  uint32
+	// The capture interface of the first packet
+	iface int
+	// The state of an SCTP association
+	astate sctpState
+	// Times of unanswered echo requests, by sequence number
+	echoes map[uint16]int64
+}
+
+// Creates the features of the flow which are to be computed.
+func (f *Flow) initFeatures() {
+	f.layout = f.cfg.layout
+	if f.layout == nil {
+		f.layout = newLayout(f.cfg)
+	}
+	f.f = make([]Feature, len(features))
+	for i, def := range features {
+		if f.layout.computed[i] {
+			f.f[i] = def.create(f.cfg)
+		}
+	}
 }
 
-func (f *Flow) Init(srcip string,
-	srcport uint16,
-	dstip string,
-	dstport uint16,
-	proto uint8,
-	pkt packet,
-	id int64) {
-	f.f = make([]Feature, NUM_FEATURES)
+// Updates the features of the flow with a packet.
+func (f *Flow) updateFeatures(pkt *Packet) {
+	for i, def := range features {
+		if def.update != nil && f.f[i] != nil {
+			def.update(f, f.f[i], pkt)
+		}
+	}
+}
+
+func (f *Flow) Init(pkt *Packet, cfg *Config) {
+	f.cfg = cfg
+	f.initFeatures()
 	f.valid = false
-	f.f[TOTAL_FPACKETS] = new(ValueFeature)
-	f.f[TOTAL_FVOLUME] = new(ValueFeature)
-	f.f[TOTAL_BPACKETS] = new(ValueFeature)
-	f.f[TOTAL_BVOLUME] = new(ValueFeature)
-	f.f[FPKTL] = new(DistributionFeature)
-	f.f[BPKTL] = new(DistributionFeature)
-	f.f[FIAT] = new(DistributionFeature)
-	f.f[BIAT] = new(DistributionFeature)
-	f.f[DURATION] = new(ValueFeature)
-	f.f[ACTIVE] = new(DistributionFeature)
-	f.f[IDLE] = new(DistributionFeature)
-	f.f[SFLOW_FPACKETS] = new(ValueFeature)
-	f.f[SFLOW_FBYTES] = new(ValueFeature)
-	f.f[SFLOW_BPACKETS] = new(ValueFeature)
-	f.f[SFLOW_BBYTES] = new(ValueFeature)
-	f.f[FPSH_CNT] = new(ValueFeature)
-	f.f[BPSH_CNT] = new(ValueFeature)
-	f.f[FURG_CNT] = new(ValueFeature)
-	f.f[BURG_CNT] = new(ValueFeature)
-	f.f[TOTAL_FHLEN] = new(ValueFeature)
-	f.f[TOTAL_BHLEN] = new(ValueFeature)
-	//for i := 0; i < NUM_FEATURES; i++ {
-	//    f.f[i].Set(0)
-	//}
 	// Basic flow identification criteria
-	f.srcip = srcip
-	f.srcport = srcport
-	f.dstip = dstip
-	f.dstport = dstport
-	f.proto = proto
-	f.dscp = uint8(pkt["dscp"])
+	f.srcip = pkt.SrcIP
+	f.srcport = pkt.SrcPort
+	f.dstip = pkt.DstIP
+	f.dstport = pkt.DstPort
+	f.proto = pkt.Proto
+	f.vlan = pkt.VLAN
+	f.innerVlan = pkt.InnerVLAN
+	f.tunnelID = pkt.TunnelID
+	f.iface = pkt.Interface
 	// ---------------------------------------------------------
-	f.f[TOTAL_FPACKETS].Set(1)
-	length := pkt["len"]
-	f.f[TOTAL_FVOLUME].Set(length)
-	f.f[FPKTL].Add(length)
-	f.firstTime = pkt["time"]
+	f.firstTime = pkt.Time
 	f.flast = f.firstTime
 	f.activeStart = f.firstTime
 	if f.proto == IP_TCP {
 		// TCP specific code:
 		f.cstate.State = TCP_STATE_START
 		f.sstate.State = TCP_STATE_START
-		if tcpSet(TCP_PSH, pkt["flags"]) {
-			f.f[FPSH_CNT].Set(1)
-		}
-		if tcpSet(TCP_URG, pkt["flags"]) {
-			f.f[FURG_CNT].Set(1)
-		}
 	}
-	f.f[TOTAL_FHLEN].Set(pkt["iphlen"] + pkt["prhlen"])
+	f.pdir = P_FORWARD
+	f.iat = -1
+	f.idle = 0
+	f.updateFeatures(pkt)
 
 	f.hasData = false
-	f.pdir = P_FORWARD
 	f.updateStatus(pkt)
 	return
 }
 
-func (f *Flow) updateTcpState(pkt packet) {
-	f.cstate.TcpUpdate(pkt["flags"], P_FORWARD, f.pdir)
-	f.sstate.TcpUpdate(pkt["flags"], P_BACKWARD, f.pdir)
+func (f *Flow) updateTcpState(pkt *Packet) {
+	f.cstate.TcpUpdate(pkt.Flags, P_FORWARD, f.pdir)
+	f.sstate.TcpUpdate(pkt.Flags, P_BACKWARD, f.pdir)
 }
 
-func (f *Flow) updateStatus(pkt packet) {
+func (f *Flow) updateStatus(pkt *Packet) {
 	if f.proto == IP_UDP {
 		if f.valid {
 			return
 		}
-		if pkt["len"] > 8 {
+		if pkt.Len > 8 {
 			f.hasData = true
 		}
 		if f.hasData && f.isBidir {
@@ -182,15 +152,54 @@ func (f *Flow) updateStatus(pkt packet) {
 	} else if f.proto == IP_TCP {
 		if !f.valid {
 			if f.cstate.State == TCP_STATE_ESTABLISHED {
-				if pkt["len"] > (pkt["iphlen"] + pkt["prhlen"]) {
+				if pkt.PayloadLen > 0 {
 					f.valid = true
 				}
 			}
 		}
 		f.updateTcpState(pkt)
+	} else if f.proto == IP_SCTP {
+		if !f.valid {
+			if f.astate.State == SCTP_STATE_ESTABLISHED {
+				if sctpSet(SCTP_DATA, pkt.Chunks) {
+					f.valid = true
+				}
+			}
+		}
+		f.astate.SctpUpdate(pkt.Chunks, P_FORWARD, f.pdir)
+	} else if f.isIcmp() {
+		// Unanswered requests and errors are of interest too.
+		f.valid = true
+	} else {
+		// Any other protocol, without ports. As for UDP, a flow needs data
+		// in both directions.
+		if f.valid {
+			return
+		}
+		if pkt.PayloadLen > 0 {
+			f.hasData = true
+		}
+		if f.hasData && f.isBidir {
+			f.valid = true
+		}
 	}
 }
 
+func (f *Flow) isIcmp() bool {
+	return f.proto == IP_ICMP || f.proto == IP_ICMP6
+}
+
+// Counts an ICMP error about a packet of the flow. The error is not otherwise
+// part of the flow, but a flow which caused errors is always exported.
+func (f *Flow) AddIcmpError(pkt *Packet) {
+	for i, def := range features {
+		if def.icmpError != nil && f.f[i] != nil {
+			def.icmpError(f, f.f[i], pkt)
+		}
+	}
+	f.valid = true
+}
+
 func (f *Flow) getLastTime() int64 {
 	if f.blast == 0 {
 		return f.flast
@@ -204,96 +213,52 @@ func (f *Flow) getLastTime() int64 {
 	return f.blast
 }
 
-func (f *Flow) Add(pkt packet, srcip string) int {
-	now := pkt["time"]
+func (f *Flow) Add(pkt *Packet) int {
+	now := pkt.Time
 	last := f.getLastTime()
 	diff := now - last
-	if diff > FLOW_TIMEOUT {
+	if diff > f.cfg.FlowTimeout.Microseconds() {
 		return ADD_IDLE
 	}
-	if now < last {
-		log.Printf("Flow: ignoring reordered packet. %d < %d\n", now, last)
-		return ADD_SUCCESS
-	}
-	length := pkt["len"]
-	hlen := pkt["iphlen"] + pkt["prhlen"]
-	if now < f.firstTime {
-		log.Fatalf("Current packet is before start of flow. %d < %d\n",
-			now,
-			f.firstTime)
+	if now < last || now < f.firstTime {
+		// The packet is ignored, and left to the caller to report.
+		return ADD_REORDERED
 	}
-	if srcip == f.srcip {
+	if pkt.SrcIP == f.srcip && pkt.SrcPort == f.srcport {
 		f.pdir = P_FORWARD // Forward
 	} else {
 		f.pdir = P_BACKWARD
 	}
-	if diff > IDLE_THRESHOLD {
-		f.f[IDLE].Add(diff)
+	f.idle = 0
+	if diff > f.cfg.IdleThreshold.Microseconds() {
+		f.idle = diff
 		// Active time stats - calculated by looking at the previous packet
 		// time and the packet time for when the last idle time ended.
-		diff = last - f.activeStart
-		f.f[ACTIVE].Add(diff)
+		f.active = last - f.activeStart
 
 		f.flast = 0
 		f.blast = 0
 		f.activeStart = now
 	}
+	f.iat = -1
 	if f.pdir == P_FORWARD {
-		if f.dscp == 0 {
-			f.dscp = uint8(pkt["dscp"])
-		}
-		// Packet is travelling in the forward direction
-		// Calculate some statistics
-		// Packet length
-		f.f[FPKTL].Add(length)
-		f.f[TOTAL_FVOLUME].Add(length)
-		f.f[TOTAL_FPACKETS].Add(1)
-		f.f[TOTAL_FHLEN].Add(hlen)
 		// Interarrival time
 		if f.flast > 0 {
-			diff = now - f.flast
-			f.f[FIAT].Add(diff)
-		}
-		if f.proto == IP_TCP {
-			// Packet is using TCP protocol
-			if tcpSet(TCP_PSH, pkt["flags"]) {
-				f.f[FPSH_CNT].Add(1)
-			}
-			if tcpSet(TCP_URG, pkt["flags"]) {
-				f.f[FURG_CNT].Add(1)
-			}
-			// Update the last forward packet time stamp
+			f.iat = now - f.flast
 		}
+		// Update the last forward packet time stamp
 		f.flast = now
 	} else {
 		// Packet is travelling in the backward direction
 		f.isBidir = true
-		if f.dscp == 0 {
-			f.dscp = uint8(pkt["dscp"])
-		}
-		// Calculate some statistics
-		// Packet length
-		f.f[BPKTL].Add(length)
-		f.f[TOTAL_BVOLUME].Add(length) // Doubles up as c_bpktl_sum from NM
-		f.f[TOTAL_BPACKETS].Add(1)
-		f.f[TOTAL_BHLEN].Add(hlen)
 		// Inter-arrival time
 		if f.blast > 0 {
-			diff = now - f.blast
-			f.f[BIAT].Add(diff)
-		}
-		if f.proto == IP_TCP {
-			// Packet is using TCP protocol
-			if tcpSet(TCP_PSH, pkt["flags"]) {
-				f.f[BPSH_CNT].Add(1)
-			}
-			if tcpSet(TCP_URG, pkt["flags"]) {
-				f.f[BURG_CNT].Add(1)
-			}
+			f.iat = now - f.blast
 		}
 		// Update the last backward packet time stamp
 		f.blast = now
 	}
+	f.updateFeatures(pkt)
 
 	// Update the status (validity, TCP connection state) of the flow.
 	f.updateStatus(pkt)
@@ -303,52 +268,56 @@ func (f *Flow) Add(pkt packet, srcip string) int {
 		f.sstate.State == TCP_STATE_CLOSED {
 		return ADD_CLOSED
 	}
+	if f.proto == IP_SCTP && f.astate.State == SCTP_STATE_CLOSED {
+		return ADD_CLOSED
+	}
 	return ADD_SUCCESS
 }
 
-func (f *Flow) Export() {
+// Finalizes the flow and hands it to the exporter. Flows which are not valid
+// are silently dropped.
+func (f *Flow) Export(e Exporter) error {
 	if !f.valid {
-		return
+		return nil
 	}
 
-	// -----------------------------------
-	// First, lets consider the last active time in the calculations in case
-	// this changes something.
-	// -----------------------------------
-	diff := f.getLastTime() - f.activeStart
-	f.f[ACTIVE].Add(diff)
-
-	// ---------------------------------
+	duration := f.getLastTime() - f.firstTime
+	if duration < 0 {
+		return fmt.Errorf("duration (%d) < 0", duration)
+	}
 	// Update Flow stats which require counters or other final calculations
-	// ---------------------------------
+	for i, def := range features {
+		if def.finish != nil && f.f[i] != nil {
+			def.finish(f, f.f[i])
+		}
+	}
+	return e.Export(f.record())
+}
 
-	// More sub-flow calculations
-	if f.f[ACTIVE].Get() > 0 {
-		f.f[SFLOW_FPACKETS].Set(f.f[TOTAL_FPACKETS].Get() / f.f[ACTIVE].Get())
-		f.f[SFLOW_FBYTES].Set(f.f[TOTAL_FVOLUME].Get() / f.f[ACTIVE].Get())
-		f.f[SFLOW_BPACKETS].Set(f.f[TOTAL_BPACKETS].Get() / f.f[ACTIVE].Get())
-		f.f[SFLOW_BBYTES].Set(f.f[TOTAL_BVOLUME].Get() / f.f[ACTIVE].Get())
+// Builds the exported record of the flow, in column order.
+func (f *Flow) record() Record {
+	var rec Record
+	for _, key := range flowKeys {
+		rec = append(rec, Field{key.name, key.value(f)})
 	}
-	f.f[DURATION].Set(f.getLastTime() - f.firstTime)
-	if f.f[DURATION].Get() < 0 {
-		log.Fatalf("duration (%d) < 0", f.f[DURATION])
+	for i, def := range features {
+		if f.layout.exported[i] {
+			rec = append(rec, f.f[i].Export(def.name)...)
+		}
 	}
+	return rec
+}
 
-	fmt.Printf("%s,%d,%s,%d,%d",
-		f.srcip,
-		f.srcport,
-		f.dstip,
-		f.dstport,
-		f.proto)
-	for i := 0; i < NUM_FEATURES; i++ {
-		fmt.Printf(",%s", f.f[i].Export())
-	}
-	fmt.Printf(",%d", f.dscp)
-	fmt.Println()
+// Returns the record of an empty flow, which gives the names and types of the
+// exported columns.
+func (cfg *Config) Schema() Record {
+	f := &Flow{cfg: cfg}
+	f.initFeatures()
+	return f.record()
 }
 
 func (f *Flow) CheckIdle(time int64) bool {
-	if (time - f.getLastTime()) > FLOW_TIMEOUT {
+	if (time - f.getLastTime()) > f.cfg.FlowTimeout.Microseconds() {
 		return true
 	}
 	return false
@@ -0,0 +1,10 @@
+module github.com/danielarndt/flowtbag
+
+go 1.22
+
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/akrennmair/gopcap v0.0.0-20150728160502-00e11033259a // Live capture, with -tags pcap
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
+)
@@ -0,0 +1,168 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"encoding/binary"
+)
+
+const (
+	ICMP_HLEN = 8
+
+	// ICMP message types
+	ICMP_ECHO_REPLY      = 0
+	ICMP_UNREACH         = 3
+	ICMP_SOURCE_QUENCH   = 4
+	ICMP_REDIRECT        = 5
+	ICMP_ECHO            = 8
+	ICMP_TIME_EXCEEDED   = 11
+	ICMP_PARAM_PROBLEM   = 12
+	ICMP_TIMESTAMP       = 13
+	ICMP_TIMESTAMP_REPLY = 14
+	ICMP_INFO            = 15
+	ICMP_INFO_REPLY      = 16
+	ICMP_MASK            = 17
+	ICMP_MASK_REPLY      = 18
+
+	// ICMPv6 message types. Types below 128 are errors.
+	ICMP6_UNREACH    = 1
+	ICMP6_ECHO       = 128
+	ICMP6_ECHO_REPLY = 129
+
+	// The most echo requests a flow waits for replies to at a time.
+	ICMP_MAX_PENDING = 64
+)
+
+// Returns the type of the request a reply answers, so that both are part of
+// the same flow. Other types are returned unchanged.
+func icmpRequestType(proto uint8, typ uint8) uint8 {
+	if proto == IP_ICMP6 {
+		if typ == ICMP6_ECHO_REPLY {
+			return ICMP6_ECHO
+		}
+		return typ
+	}
+	switch typ {
+	case ICMP_ECHO_REPLY:
+		return ICMP_ECHO
+	case ICMP_TIMESTAMP_REPLY, ICMP_INFO_REPLY, ICMP_MASK_REPLY:
+		return typ - 1
+	}
+	return typ
+}
+
+// Returns whether the packet is an ICMP or ICMPv6 error message, which quotes
+// the header of the packet that caused it.
+func (p *Packet) IsIcmpError() bool {
+	switch p.Proto {
+	case IP_ICMP:
+		switch p.IcmpType {
+		case ICMP_UNREACH, ICMP_SOURCE_QUENCH, ICMP_REDIRECT,
+			ICMP_TIME_EXCEEDED, ICMP_PARAM_PROBLEM:
+			return true
+		}
+	case IP_ICMP6:
+		return p.IcmpType < 128
+	}
+	return false
+}
+
+// Returns whether the packet is a destination unreachable message.
+func (p *Packet) IsUnreachable() bool {
+	return (p.Proto == IP_ICMP && p.IcmpType == ICMP_UNREACH) ||
+		(p.Proto == IP_ICMP6 && p.IcmpType == ICMP6_UNREACH)
+}
+
+// Returns whether the packet is an echo request.
+func (p *Packet) IsEchoRequest() bool {
+	return (p.Proto == IP_ICMP && p.IcmpType == ICMP_ECHO) ||
+		(p.Proto == IP_ICMP6 && p.IcmpType == ICMP6_ECHO)
+}
+
+// Returns whether the packet is an echo reply.
+func (p *Packet) IsEchoReply() bool {
+	return (p.Proto == IP_ICMP && p.IcmpType == ICMP_ECHO_REPLY) ||
+		(p.Proto == IP_ICMP6 && p.IcmpType == ICMP6_ECHO_REPLY)
+}
+
+// Decodes the ICMP or ICMPv6 header at the start of data. The identifier of
+// queries is held in SrcPort, and the type (of the request, for replies) and
+// code in DstPort, so that both directions of an exchange share a key.
+//
+// Errors quote the packet which caused them. If that was not itself an ICMP
+// message, Inner is set to the key of its flow, and SrcPort to a hash of it,
+// so that errors about different flows are kept apart.
+func (p *Packet) decodeIcmp(data []byte) error {
+	if len(data) < ICMP_HLEN {
+		return ErrTruncated
+	}
+	p.IcmpType = data[0]
+	p.IcmpCode = data[1]
+	p.PrHLen = ICMP_HLEN
+	p.PayloadLen = p.Len - p.IPHLen - ICMP_HLEN
+	p.DstPort = uint16(icmpRequestType(p.Proto, p.IcmpType))<<8 |
+		uint16(p.IcmpCode)
+	switch {
+	case p.IsIcmpError():
+		inner := Packet{VLAN: p.VLAN, InnerVLAN: p.InnerVLAN,
+			TunnelID: p.TunnelID}
+		if inner.decodeQuoted(p.Proto, data[ICMP_HLEN:]) {
+			p.Inner = inner.Key()
+			p.HasInner = true
+			p.SrcPort = uint16(p.Inner.Hash())
+		}
+	case p.Proto == IP_ICMP6 && p.IcmpType > ICMP6_ECHO_REPLY:
+		// Neighbour discovery and the like have no identifier.
+	case p.Proto == IP_ICMP && p.IcmpType > ICMP_MASK_REPLY:
+	default:
+		p.SrcPort = binary.BigEndian.Uint16(data[4:6])
+		p.IcmpSeq = binary.BigEndian.Uint16(data[6:8])
+	}
+	return nil
+}
+
+// Decodes the IP header, and the ports of a TCP, UDP or SCTP header, quoted in
+// an ICMP error. Only the first 8 bytes of the transport header are quoted.
+// Returns whether the packet belongs to a flow an error can be counted in.
+func (p *Packet) decodeQuoted(icmpProto uint8, data []byte) bool {
+	var (
+		payload []byte
+		err     error
+	)
+	if icmpProto == IP_ICMP6 {
+		payload, err = p.decodeIp6(data)
+	} else {
+		payload, err = p.decodeIp4(data)
+	}
+	if err != nil {
+		return false
+	}
+	switch p.Proto {
+	case IP_ICMP, IP_ICMP6:
+		return false
+	case IP_TCP, IP_UDP, IP_SCTP:
+		if len(payload) < 4 {
+			return false
+		}
+		p.SrcPort = binary.BigEndian.Uint16(payload[0:2])
+		p.DstPort = binary.BigEndian.Uint16(payload[2:4])
+	}
+	return true
+}
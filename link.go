@@ -0,0 +1,197 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// The link-layer header type of a capture, as given in pcap and pcapng files.
+type LinkType int
+
+const (
+	LINKTYPE_NULL       LinkType = 0 // BSD loopback, host byte order family
+	LINKTYPE_ETHERNET   LinkType = 1
+	LINKTYPE_RAW_OLD    LinkType = 12 // Raw IP, as numbered on some systems
+	LINKTYPE_RAW        LinkType = 101
+	LINKTYPE_IEEE802_11 LinkType = 105
+	LINKTYPE_LOOP       LinkType = 108 // OpenBSD loopback, network byte order family
+	LINKTYPE_LINUX_SLL  LinkType = 113
+	LINKTYPE_RADIOTAP   LinkType = 127
+	LINKTYPE_IPV4       LinkType = 228
+	LINKTYPE_IPV6       LinkType = 229
+	LINKTYPE_LINUX_SLL2 LinkType = 276
+)
+
+var linkTypeNames = map[LinkType]string{
+	LINKTYPE_NULL:       "NULL",
+	LINKTYPE_ETHERNET:   "EN10MB",
+	LINKTYPE_RAW_OLD:    "RAW",
+	LINKTYPE_RAW:        "RAW",
+	LINKTYPE_IEEE802_11: "IEEE802_11",
+	LINKTYPE_LOOP:       "LOOP",
+	LINKTYPE_LINUX_SLL:  "LINUX_SLL",
+	LINKTYPE_RADIOTAP:   "IEEE802_11_RADIO",
+	LINKTYPE_IPV4:       "IPV4",
+	LINKTYPE_IPV6:       "IPV6",
+	LINKTYPE_LINUX_SLL2: "LINUX_SLL2",
+}
+
+const (
+	NULL_HLEN      = 4
+	SLL_HLEN       = 16
+	SLL2_HLEN      = 20
+	RADIOTAP_HLEN  = 8 // The fixed part
+	WIFI_HLEN      = 24
+	LLC_SNAP_HLEN  = 8
+	WIFI_TYPE_DATA = 2
+
+	// Address families of loopback captures. IPv6 is numbered differently
+	// by each system.
+	AF_INET        = 2
+	AF_INET6_LINUX = 10
+	AF_INET6_BSD   = 24
+	AF_INET6_BSD2  = 28
+	AF_INET6_BSD3  = 30
+)
+
+func (l LinkType) String() string {
+	if name, ok := linkTypeNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", int(l))
+}
+
+// Returns an error if packets with the given link type cannot be decoded.
+func (l LinkType) Check() error {
+	if _, ok := linkTypeNames[l]; !ok {
+		return fmt.Errorf("unsupported link type %d. Supported link types "+
+			"are EN10MB, LINUX_SLL, LINUX_SLL2, RAW, IPV4, IPV6, NULL, LOOP, "+
+			"IEEE802_11 and IEEE802_11_RADIO", int(l))
+	}
+	return nil
+}
+
+// Decodes a packet with the given link-layer header type, captured at the
+// given time. It is otherwise the same as Decode.
+func (p *Packet) DecodeLink(link LinkType, data []byte,
+	timestamp time.Time) error {
+	*p = Packet{Time: timestamp.UnixMicro()}
+	switch link {
+	case LINKTYPE_ETHERNET:
+		return p.decodeEthernet(data, 0)
+	case LINKTYPE_RAW, LINKTYPE_RAW_OLD:
+		if len(data) == 0 {
+			return ErrTruncated
+		}
+		switch data[0] >> 4 {
+		case 4:
+			return p.decodeNetwork(ETHERTYPE_IP, data, 0)
+		case 6:
+			return p.decodeNetwork(ETHERTYPE_IP6, data, 0)
+		}
+		return ErrUnsupported
+	case LINKTYPE_IPV4:
+		return p.decodeNetwork(ETHERTYPE_IP, data, 0)
+	case LINKTYPE_IPV6:
+		return p.decodeNetwork(ETHERTYPE_IP6, data, 0)
+	case LINKTYPE_NULL, LINKTYPE_LOOP:
+		if len(data) < NULL_HLEN {
+			return ErrTruncated
+		}
+		family := binary.BigEndian.Uint32(data[0:4])
+		if link == LINKTYPE_NULL && family > 0xffff {
+			// Written in the byte order of a little endian host.
+			family = binary.LittleEndian.Uint32(data[0:4])
+		}
+		switch family {
+		case AF_INET:
+			return p.decodeNetwork(ETHERTYPE_IP, data, NULL_HLEN)
+		case AF_INET6_LINUX, AF_INET6_BSD, AF_INET6_BSD2, AF_INET6_BSD3:
+			return p.decodeNetwork(ETHERTYPE_IP6, data, NULL_HLEN)
+		}
+		return ErrUnsupported
+	case LINKTYPE_LINUX_SLL:
+		if len(data) < SLL_HLEN {
+			return ErrTruncated
+		}
+		protocol := binary.BigEndian.Uint16(data[14:16])
+		return p.decodeEthertype(protocol, data, SLL_HLEN)
+	case LINKTYPE_LINUX_SLL2:
+		if len(data) < SLL2_HLEN {
+			return ErrTruncated
+		}
+		protocol := binary.BigEndian.Uint16(data[0:2])
+		return p.decodeEthertype(protocol, data, SLL2_HLEN)
+	case LINKTYPE_RADIOTAP:
+		if len(data) < RADIOTAP_HLEN {
+			return ErrTruncated
+		}
+		hlen := int(binary.LittleEndian.Uint16(data[2:4]))
+		if hlen < RADIOTAP_HLEN {
+			return fmt.Errorf("%w: radiotap header length %d", ErrMalformed,
+				hlen)
+		}
+		return p.decodeWifi(data, hlen)
+	case LINKTYPE_IEEE802_11:
+		return p.decodeWifi(data, 0)
+	}
+	// Files with several interfaces may have some which cannot be decoded.
+	return fmt.Errorf("%w: link type %s", ErrUnsupported, link)
+}
+
+// Decodes the 802.11 frame at offset in data. Only unencrypted data frames
+// carry packets which can be decoded.
+func (p *Packet) decodeWifi(data []byte, offset int) error {
+	if len(data) < offset+WIFI_HLEN {
+		return ErrTruncated
+	}
+	fc0, fc1 := data[offset], data[offset+1]
+	if (fc0>>2)&0x03 != WIFI_TYPE_DATA {
+		return ErrUnsupported
+	}
+	subtype := fc0 >> 4
+	if subtype&0x04 != 0 || fc1&0x40 != 0 {
+		// Frames without a body, and protected frames.
+		return ErrUnsupported
+	}
+	hlen := WIFI_HLEN
+	if fc1&0x03 == 0x03 {
+		hlen += 6 // A fourth address, between access points
+	}
+	if subtype&0x08 != 0 {
+		hlen += 2 // QoS control
+		if fc1&0x80 != 0 {
+			hlen += 4 // HT control
+		}
+	}
+	offset += hlen
+	if len(data) < offset+LLC_SNAP_HLEN {
+		return ErrTruncated
+	}
+	llc := data[offset : offset+LLC_SNAP_HLEN]
+	if llc[0] != 0xaa || llc[1] != 0xaa || llc[2] != 0x03 {
+		return ErrUnsupported
+	}
+	ethertype := binary.BigEndian.Uint16(llc[6:8])
+	return p.decodeEthertype(ethertype, data, offset+LLC_SNAP_HLEN)
+}
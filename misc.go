@@ -17,21 +17,7 @@
  *
  */
 
-package main
-
-import (
-	"math"
-)
-
-// Calculates the standard deviation of a feature.
-func stddev(sqsum float64, sum float64, count int64) float64 {
-	if count < 2 {
-		return 0
-	}
-	n := float64(count)
-	stddev := math.Sqrt((sqsum - (sum * sum / n)) / (n - 1))
-	return stddev
-}
+package flowtbag
 
 // Returns the minimum of two int64
 func Min64(i1 int64, i2 int64) int64 {
@@ -0,0 +1,99 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+// Builders for the packets used by the tests.
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// Joins byte slices.
+func cat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+// Sets the checksum of an IPv4 header without options.
+func ip4Checksum(ip []byte) {
+	ip[10], ip[11] = 0, 0
+	var sum uint32
+	for i := 0; i < IP4_MIN_HLEN; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(ip[10:], ^uint16(sum))
+}
+
+// Returns an IPv4 packet carrying body.
+func ip4(src, dst string, proto uint8, body []byte) []byte {
+	b := make([]byte, IP4_MIN_HLEN+len(body))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	b[8] = 64
+	b[9] = proto
+	copy(b[12:], net.ParseIP(src).To4())
+	copy(b[16:], net.ParseIP(dst).To4())
+	ip4Checksum(b)
+	copy(b[IP4_MIN_HLEN:], body)
+	return b
+}
+
+// Returns an ethernet frame with the given ethertype carrying body.
+func ether(ethertype uint16, body []byte) []byte {
+	return cat(make([]byte, 12), be16(ethertype), body)
+}
+
+// Returns a UDP header followed by n bytes of payload.
+func udp(sport, dport uint16, n int) []byte {
+	b := make([]byte, UDP_HLEN+n)
+	binary.BigEndian.PutUint16(b[0:], sport)
+	binary.BigEndian.PutUint16(b[2:], dport)
+	binary.BigEndian.PutUint16(b[4:], uint16(UDP_HLEN+n))
+	return b
+}
+
+// Returns the value of the named field of a record, or nil.
+func field(rec Record, name string) interface{} {
+	for _, f := range rec {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return nil
+}
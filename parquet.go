@@ -0,0 +1,360 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	PARQUET_MAGIC = "PAR1"
+	// The number of flows buffered in memory before a row group is written.
+	PARQUET_ROW_GROUP = 65536
+
+	// Parquet physical types
+	PARQUET_INT64      = 2
+	PARQUET_DOUBLE     = 5
+	PARQUET_BYTE_ARRAY = 6
+
+	PARQUET_PLAIN     = 0 // Encoding of the values
+	PARQUET_RLE       = 3 // Encoding of the (unused) levels
+	PARQUET_UTF8      = 0 // Converted type of string columns
+	PARQUET_REQUIRED  = 0 // Repetition type of every column
+	PARQUET_DATA_PAGE = 0
+)
+
+// Writes flows to an Apache Parquet file. Every column is required, plain
+// encoded and uncompressed, and holds a single data page per row group. The
+// column types are taken from the values in the schema.
+type parquetExporter struct {
+	w       *countingWriter
+	columns []parquetColumn
+	rows    int64             // Rows in the current row group
+	total   int64             // Rows in the file
+	groups  []parquetRowGroup // Row groups written so far
+	started bool              // Whether the file magic has been written
+}
+
+type parquetColumn struct {
+	name  string
+	ptype int32
+	data  []byte // Plain encoded values of the current row group
+}
+
+type parquetChunk struct {
+	offset int64 // Offset of the page header in the file
+	size   int64 // Size of the page header and data
+}
+
+type parquetRowGroup struct {
+	chunks []parquetChunk
+	size   int64
+	rows   int64
+}
+
+// Counts the bytes written, so that the offsets of pages are known.
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Creates an Exporter which writes an Apache Parquet file with the columns of
+// schema. Nothing is readable until the Exporter is closed.
+func NewParquetExporter(w io.Writer, schema Record) Exporter {
+	e := &parquetExporter{w: &countingWriter{w: bufio.NewWriter(w)}}
+	for _, field := range schema {
+		col := parquetColumn{name: field.Name}
+		switch field.Value.(type) {
+		case int64:
+			col.ptype = PARQUET_INT64
+		case float64:
+			col.ptype = PARQUET_DOUBLE
+		default:
+			col.ptype = PARQUET_BYTE_ARRAY
+		}
+		e.columns = append(e.columns, col)
+	}
+	return e
+}
+
+func (e *parquetExporter) start() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+	_, err := io.WriteString(e.w, PARQUET_MAGIC)
+	return err
+}
+
+func (e *parquetExporter) Export(rec Record) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	if len(rec) != len(e.columns) {
+		return fmt.Errorf("parquet: flow has %d fields, expected %d",
+			len(rec), len(e.columns))
+	}
+	for i, field := range rec {
+		col := &e.columns[i]
+		switch v := field.Value.(type) {
+		case int64:
+			if col.ptype != PARQUET_INT64 {
+				return fmt.Errorf("parquet: unexpected integer in %s", col.name)
+			}
+			col.data = binary.LittleEndian.AppendUint64(col.data, uint64(v))
+		case float64:
+			if col.ptype != PARQUET_DOUBLE {
+				return fmt.Errorf("parquet: unexpected float in %s", col.name)
+			}
+			col.data = binary.LittleEndian.AppendUint64(col.data,
+				math.Float64bits(v))
+		case string:
+			if col.ptype != PARQUET_BYTE_ARRAY {
+				return fmt.Errorf("parquet: unexpected string in %s", col.name)
+			}
+			col.data = binary.LittleEndian.AppendUint32(col.data,
+				uint32(len(v)))
+			col.data = append(col.data, v...)
+		default:
+			return fmt.Errorf("parquet: unsupported value in %s", col.name)
+		}
+	}
+	e.rows++
+	if e.rows >= PARQUET_ROW_GROUP {
+		return e.writeRowGroup()
+	}
+	return nil
+}
+
+// Writes out the buffered rows as a row group, with one page per column.
+func (e *parquetExporter) writeRowGroup() error {
+	if e.rows == 0 {
+		return nil
+	}
+	group := parquetRowGroup{rows: e.rows}
+	for i := range e.columns {
+		col := &e.columns[i]
+		var t thriftWriter
+		t.begin()
+		t.i32(1, PARQUET_DATA_PAGE)
+		t.i32(2, int32(len(col.data)))
+		t.i32(3, int32(len(col.data)))
+		t.beginStruct(5) // DataPageHeader
+		t.i32(1, int32(e.rows))
+		t.i32(2, PARQUET_PLAIN)
+		t.i32(3, PARQUET_RLE)
+		t.i32(4, PARQUET_RLE)
+		t.endStruct()
+		t.end()
+		chunk := parquetChunk{offset: e.w.n}
+		if _, err := e.w.Write(t.buf); err != nil {
+			return err
+		}
+		if _, err := e.w.Write(col.data); err != nil {
+			return err
+		}
+		chunk.size = e.w.n - chunk.offset
+		group.size += chunk.size
+		group.chunks = append(group.chunks, chunk)
+		col.data = col.data[:0]
+	}
+	e.groups = append(e.groups, group)
+	e.total += e.rows
+	e.rows = 0
+	return nil
+}
+
+func (e *parquetExporter) Flush() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	if err := e.writeRowGroup(); err != nil {
+		return err
+	}
+	return e.w.w.Flush()
+}
+
+// Writes out the remaining rows and the file footer.
+func (e *parquetExporter) Close() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	if err := e.writeRowGroup(); err != nil {
+		return err
+	}
+	var t thriftWriter
+	t.begin()
+	t.i32(1, 1) // version
+	t.listHeader(2, THRIFT_STRUCT, len(e.columns)+1)
+	t.beginElement()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(e.columns)))
+	t.endStruct()
+	for _, col := range e.columns {
+		t.beginElement()
+		t.i32(1, col.ptype)
+		t.i32(3, PARQUET_REQUIRED)
+		t.binary(4, col.name)
+		if col.ptype == PARQUET_BYTE_ARRAY {
+			t.i32(6, PARQUET_UTF8)
+		}
+		t.endStruct()
+	}
+	t.i64(3, e.total)
+	t.listHeader(4, THRIFT_STRUCT, len(e.groups))
+	for _, group := range e.groups {
+		t.beginElement()
+		t.listHeader(1, THRIFT_STRUCT, len(group.chunks))
+		for i, chunk := range group.chunks {
+			col := e.columns[i]
+			t.beginElement()
+			t.i64(2, chunk.offset)
+			t.beginStruct(3) // ColumnMetaData
+			t.i32(1, col.ptype)
+			t.listHeader(2, THRIFT_I32, 1)
+			t.varint(zigzag(PARQUET_PLAIN))
+			t.listHeader(3, THRIFT_BINARY, 1)
+			t.varint(uint64(len(col.name)))
+			t.buf = append(t.buf, col.name...)
+			t.i32(4, 0) // Uncompressed
+			t.i64(5, group.rows)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.endStruct()
+			t.endStruct()
+		}
+		t.i64(2, group.size)
+		t.i64(3, group.rows)
+		t.endStruct()
+	}
+	t.binary(6, "flowtbag")
+	t.end()
+	if _, err := e.w.Write(t.buf); err != nil {
+		return err
+	}
+	length := binary.LittleEndian.AppendUint32(nil, uint32(len(t.buf)))
+	if _, err := e.w.Write(length); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(e.w, PARQUET_MAGIC); err != nil {
+		return err
+	}
+	return e.w.w.Flush()
+}
+
+// Thrift compact protocol types
+const (
+	THRIFT_I32    = 5
+	THRIFT_I64    = 6
+	THRIFT_BINARY = 8
+	THRIFT_LIST   = 9
+	THRIFT_STRUCT = 12
+)
+
+// A minimal encoder for the Thrift compact protocol, which Parquet uses for
+// its page headers and file footer.
+type thriftWriter struct {
+	buf  []byte
+	last []int16 // The last field id written in each open struct
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf = binary.AppendUvarint(t.buf, v)
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := t.last[len(t.last)-1]
+	if id > last && id-last <= 15 {
+		t.buf = append(t.buf, byte(id-last)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.varint(zigzag(int64(id)))
+	}
+	t.last[len(t.last)-1] = id
+}
+
+// Starts the top level struct.
+func (t *thriftWriter) begin() {
+	t.last = append(t.last, 0)
+}
+
+// Ends the top level struct.
+func (t *thriftWriter) end() {
+	t.endStruct()
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, THRIFT_I32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, THRIFT_I64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, THRIFT_BINARY)
+	t.varint(uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+// Starts a struct valued field. It must be closed with endStruct.
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, THRIFT_STRUCT)
+	t.last = append(t.last, 0)
+}
+
+// Starts a struct which is an element of a list. It must be closed with
+// endStruct.
+func (t *thriftWriter) beginElement() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf = append(t.buf, 0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// Starts a list valued field. The size elements must follow.
+func (t *thriftWriter) listHeader(id int16, elemType byte, size int) {
+	t.field(id, THRIFT_LIST)
+	if size < 15 {
+		t.buf = append(t.buf, byte(size)<<4|elemType)
+	} else {
+		t.buf = append(t.buf, 0xf0|elemType)
+		t.varint(uint64(size))
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// A minimal decoder for the Thrift compact protocol, for reading back the
+// metadata written by the parquet exporter.
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) byte() byte {
+	b := r.buf[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case THRIFT_I32, THRIFT_I64:
+		return r.zigzag()
+	case THRIFT_BINARY:
+		n := int(r.varint())
+		r.pos += n
+		return string(r.buf[r.pos-n : r.pos])
+	case THRIFT_LIST:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.varint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(h & 0xf)
+		}
+		return list
+	case THRIFT_STRUCT:
+		return r.structure()
+	}
+	panic("unexpected thrift type")
+}
+
+// Reads a struct as a map from field ids to values.
+func (r *thriftReader) structure() map[int16]interface{} {
+	s := make(map[int16]interface{})
+	var last int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return s
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.zigzag())
+		}
+		s[id] = r.value(h & 0xf)
+		last = id
+	}
+}
+
+// Reads a parquet file written by the exporter, returning the names and
+// physical types of its columns, its number of rows, and the values of each
+// column.
+func readParquet(t *testing.T, file []byte) ([]string, []int64, int64,
+	[][]interface{}) {
+	if string(file[:4]) != PARQUET_MAGIC ||
+		string(file[len(file)-4:]) != PARQUET_MAGIC {
+		t.Fatal("missing magic")
+	}
+	n := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	r := &thriftReader{buf: file, pos: len(file) - 8 - n}
+	meta := r.structure()
+	if r.pos != len(file)-8 {
+		t.Fatalf("footer of %d bytes, read %d", n, r.pos-(len(file)-8-n))
+	}
+	var names []string
+	var types []int64
+	schema := meta[2].([]interface{})
+	for _, elem := range schema[1:] {
+		elem := elem.(map[int16]interface{})
+		names = append(names, elem[4].(string))
+		types = append(types, elem[1].(int64))
+	}
+	if schema[0].(map[int16]interface{})[5].(int64) != int64(len(names)) {
+		t.Error("root element has the wrong number of children")
+	}
+	values := make([][]interface{}, len(names))
+	for _, group := range meta[4].([]interface{}) {
+		group := group.(map[int16]interface{})
+		for i, chunk := range group[1].([]interface{}) {
+			md := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			r := &thriftReader{buf: file, pos: int(md[9].(int64))}
+			page := r.structure()
+			rows := page[5].(map[int16]interface{})[1].(int64)
+			if rows != group[3].(int64) || rows != md[5].(int64) {
+				t.Errorf("%s: page of %d rows in a group of %d", names[i],
+					rows, group[3])
+			}
+			data := file[r.pos : r.pos+int(page[2].(int64))]
+			for ; rows > 0; rows-- {
+				switch types[i] {
+				case PARQUET_INT64:
+					values[i] = append(values[i],
+						int64(binary.LittleEndian.Uint64(data)))
+					data = data[8:]
+				case PARQUET_DOUBLE:
+					values[i] = append(values[i], math.Float64frombits(
+						binary.LittleEndian.Uint64(data)))
+					data = data[8:]
+				case PARQUET_BYTE_ARRAY:
+					n := binary.LittleEndian.Uint32(data)
+					values[i] = append(values[i], string(data[4:4+n]))
+					data = data[4+n:]
+				}
+			}
+			if len(data) != 0 {
+				t.Errorf("%s: %d bytes left in page", names[i], len(data))
+			}
+		}
+	}
+	return names, types, meta[3].(int64), values
+}
+
+func TestParquet(t *testing.T) {
+	schema := Record{{"srcip", ""}, {"srcport", int64(0)},
+		{"mean_fpktl", 0.0}}
+	rows := []Record{
+		{{"srcip", "10.0.0.1"}, {"srcport", int64(80)},
+			{"mean_fpktl", 1.5}},
+		{{"srcip", "::1"}, {"srcport", int64(-1)}, {"mean_fpktl", 0.0}},
+		{{"srcip", ""}, {"srcport", int64(1 << 40)},
+			{"mean_fpktl", -2.25}},
+	}
+	var buf bytes.Buffer
+	e := NewParquetExporter(&buf, schema)
+	for i, rec := range rows {
+		if err := e.Export(rec); err != nil {
+			t.Fatal(err)
+		}
+		// Split the rows over two row groups.
+		if i == 0 {
+			if err := e.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	names, types, total, values := readParquet(t, buf.Bytes())
+	if !reflect.DeepEqual(names, []string{"srcip", "srcport", "mean_fpktl"}) {
+		t.Errorf("got columns %v", names)
+	}
+	if !reflect.DeepEqual(types, []int64{PARQUET_BYTE_ARRAY, PARQUET_INT64,
+		PARQUET_DOUBLE}) {
+		t.Errorf("got types %v", types)
+	}
+	if total != int64(len(rows)) {
+		t.Errorf("got %d rows", total)
+	}
+	for i, name := range names {
+		for j, rec := range rows {
+			if j >= len(values[i]) || values[i][j] != rec[i].Value {
+				t.Errorf("%s: got %v", name, values[i])
+				break
+			}
+		}
+	}
+}
+
+func TestParquetEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewParquetExporter(&buf, Record{{"srcport", int64(0)}})
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	names, _, total, _ := readParquet(t, buf.Bytes())
+	if len(names) != 1 || total != 0 {
+		t.Errorf("got columns %v and %d rows", names, total)
+	}
+}
+
+func TestParquetMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewParquetExporter(&buf, Record{{"srcport", int64(0)}})
+	if e.Export(Record{{"srcport", 1.5}}) == nil {
+		t.Error("float accepted in an integer column")
+	}
+	if e.Export(Record{}) == nil {
+		t.Error("short record accepted")
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	PCAP_MAGIC      = 0xa1b2c3d4 // Microsecond timestamps
+	PCAP_MAGIC_NANO = 0xa1b23c4d // Nanosecond timestamps
+	PCAP_HLEN       = 24
+	PCAP_REC_HLEN   = 16
+	// The largest record read, so that a damaged length cannot exhaust
+	// memory.
+	PCAP_MAX_RECORD = 16 << 20
+)
+
+// The error returned when a pcap file cannot be read.
+var ErrPcap = errors.New("malformed pcap file")
+
+// Reads packets from a classic pcap file, written in either byte order with
+// microsecond or nanosecond timestamps.
+type PcapReader struct {
+	r       *bufio.Reader
+	order   binary.ByteOrder
+	nano    bool
+	link    LinkType
+	snapLen int
+}
+
+// Returns whether data starts like a pcap file.
+func IsPcap(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	for _, magic := range []uint32{binary.LittleEndian.Uint32(data),
+		binary.BigEndian.Uint32(data)} {
+		if magic == PCAP_MAGIC || magic == PCAP_MAGIC_NANO {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates a PcapReader, and reads the file header.
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	pr := &PcapReader{r: bufio.NewReaderSize(r, CAPTURE_BUFFER)}
+	var head [PCAP_HLEN]byte
+	if _, err := io.ReadFull(pr.r, head[:]); err != nil {
+		return nil, fmt.Errorf("%w: truncated file header", ErrPcap)
+	}
+	pr.order = binary.LittleEndian
+	magic := pr.order.Uint32(head[0:4])
+	if magic != PCAP_MAGIC && magic != PCAP_MAGIC_NANO {
+		pr.order = binary.BigEndian
+		magic = pr.order.Uint32(head[0:4])
+	}
+	switch magic {
+	case PCAP_MAGIC:
+	case PCAP_MAGIC_NANO:
+		pr.nano = true
+	default:
+		return nil, fmt.Errorf("%w: bad magic number", ErrPcap)
+	}
+	if major := pr.order.Uint16(head[4:6]); major != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrPcap, major)
+	}
+	pr.snapLen = int(pr.order.Uint32(head[16:20]))
+	// The upper bits may say whether frames carry a checksum.
+	pr.link = LinkType(pr.order.Uint32(head[20:24]) & 0xffff)
+	return pr, nil
+}
+
+// Returns the link-layer header type of every packet in the file.
+func (pr *PcapReader) LinkType() LinkType {
+	return pr.link
+}
+
+// Returns the most bytes captured of each packet.
+func (pr *PcapReader) SnapLen() int {
+	return pr.snapLen
+}
+
+// Reads the next packet.
+func (pr *PcapReader) ReadPacket() (*RawPacket, error) {
+	var head [PCAP_REC_HLEN]byte
+	if _, err := io.ReadFull(pr.r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: truncated record header", ErrPcap)
+		}
+		return nil, err
+	}
+	secs := int64(pr.order.Uint32(head[0:4]))
+	frac := int64(pr.order.Uint32(head[4:8]))
+	caplen := pr.order.Uint32(head[8:12])
+	length := pr.order.Uint32(head[12:16])
+	if caplen > PCAP_MAX_RECORD {
+		return nil, fmt.Errorf("%w: bad captured length %d", ErrPcap, caplen)
+	}
+	if !pr.nano {
+		frac *= int64(time.Microsecond)
+	}
+	raw := &RawPacket{
+		Data:     make([]byte, caplen),
+		Time:     time.Unix(secs, frac),
+		Length:   int(length),
+		LinkType: pr.link,
+	}
+	if _, err := io.ReadFull(pr.r, raw.Data); err != nil {
+		return nil, fmt.Errorf("%w: truncated packet", ErrPcap)
+	}
+	return raw, nil
+}
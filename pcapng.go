@@ -0,0 +1,434 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// pcapng block types
+const (
+	PCAPNG_SHB = 0x0a0d0d0a // Section header
+	PCAPNG_IDB = 0x00000001 // Interface description
+	PCAPNG_PB  = 0x00000002 // Packet, obsolete
+	PCAPNG_SPB = 0x00000003 // Simple packet
+	PCAPNG_ISB = 0x00000005 // Interface statistics
+	PCAPNG_EPB = 0x00000006 // Enhanced packet
+)
+
+// pcapng option codes
+const (
+	OPT_ENDOFOPT      = 0
+	OPT_COMMENT       = 1
+	IF_NAME           = 2
+	IF_DESCRIPTION    = 3
+	IF_TSRESOL        = 9
+	IF_TSOFFSET       = 14
+	EPB_DROPCOUNT     = 4
+	ISB_IFRECV        = 4
+	ISB_IFDROP        = 5
+	ISB_FILTERACCEPT  = 6
+	ISB_OSDROP        = 7
+	PCAPNG_BYTE_ORDER = 0x1a2b3c4d
+	// The largest block read, so that a damaged length cannot exhaust memory.
+	PCAPNG_MAX_BLOCK = 64 << 20
+)
+
+// The error returned when a pcapng file cannot be read.
+var ErrPcapng = errors.New("malformed pcapng file")
+
+// An interface described in a pcapng file, with the statistics recorded for
+// it. Statistics which were not recorded are -1.
+type PcapngInterface struct {
+	LinkType    LinkType
+	SnapLen     int
+	Name        string
+	Description string
+	Comments    []string
+	Received    int64 // Packets received by the interface
+	IfDropped   int64 // Packets dropped by the interface
+	OSDropped   int64 // Packets dropped by the operating system
+	Accepted    int64 // Packets accepted by the capture filter
+	Dropped     int64 // Packets lost since the previous one, summed over packets
+
+	units  uint64 // Timestamp units per second
+	offset int64  // Seconds added to every timestamp
+}
+
+// Reads packets from a pcapng file. Each section of the file may describe
+// several interfaces, each with its own link type and timestamp resolution.
+type PcapngReader struct {
+	r          *bufio.Reader
+	order      binary.ByteOrder
+	section    int                // The first interface of the current section
+	interfaces []*PcapngInterface // Of every section read so far
+	comments   []string           // Of the section headers
+	buf        []byte
+}
+
+// Returns whether data starts like a pcapng file.
+func IsPcapng(data []byte) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data) == PCAPNG_SHB
+}
+
+// Creates a PcapngReader, and reads the first section header.
+func NewPcapngReader(r io.Reader) (*PcapngReader, error) {
+	pr := &PcapngReader{r: bufio.NewReaderSize(r, CAPTURE_BUFFER)}
+	kind, body, err := pr.readBlock()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: empty file", ErrPcapng)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if kind != PCAPNG_SHB {
+		return nil, fmt.Errorf("%w: no section header", ErrPcapng)
+	}
+	return pr, pr.startSection(body)
+}
+
+// Returns the interfaces described so far, numbered as in RawPacket.
+func (pr *PcapngReader) Interfaces() []*PcapngInterface {
+	return pr.interfaces
+}
+
+// Returns the comments of the section headers read so far.
+func (pr *PcapngReader) Comments() []string {
+	return pr.comments
+}
+
+// Reads the next block, returning its type and body. The body is only valid
+// until the next call.
+func (pr *PcapngReader) readBlock() (uint32, []byte, error) {
+	var head [12]byte
+	if _, err := io.ReadFull(pr.r, head[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, fmt.Errorf("%w: truncated block", ErrPcapng)
+		}
+		return 0, nil, err
+	}
+	kind := binary.LittleEndian.Uint32(head[0:4])
+	if kind == PCAPNG_SHB {
+		// The byte order is only known once the section header is read.
+		if _, err := io.ReadFull(pr.r, head[8:12]); err != nil {
+			return 0, nil, fmt.Errorf("%w: truncated section header",
+				ErrPcapng)
+		}
+		switch uint32(PCAPNG_BYTE_ORDER) {
+		case binary.LittleEndian.Uint32(head[8:12]):
+			pr.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(head[8:12]):
+			pr.order = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("%w: bad byte order magic", ErrPcapng)
+		}
+	}
+	kind = pr.order.Uint32(head[0:4])
+	length := pr.order.Uint32(head[4:8])
+	if length < 12 || length%4 != 0 || length > PCAPNG_MAX_BLOCK {
+		return 0, nil, fmt.Errorf("%w: bad block length %d", ErrPcapng,
+			length)
+	}
+	read := 8
+	if kind == PCAPNG_SHB {
+		read = 12
+		if length < 28 {
+			return 0, nil, fmt.Errorf("%w: bad block length %d", ErrPcapng,
+				length)
+		}
+	}
+	size := int(length) - read
+	if cap(pr.buf) < size {
+		pr.buf = make([]byte, size)
+	}
+	body := pr.buf[:size]
+	if _, err := io.ReadFull(pr.r, body); err != nil {
+		return 0, nil, fmt.Errorf("%w: truncated block", ErrPcapng)
+	}
+	if pr.order.Uint32(body[size-4:]) != length {
+		return 0, nil, fmt.Errorf("%w: block lengths differ", ErrPcapng)
+	}
+	return kind, body[:size-4], nil
+}
+
+// Calls fn with the code and value of each option in data.
+func (pr *PcapngReader) options(data []byte, fn func(code uint16,
+	value []byte)) error {
+	for len(data) >= 4 {
+		code := pr.order.Uint16(data[0:2])
+		length := int(pr.order.Uint16(data[2:4]))
+		if code == OPT_ENDOFOPT {
+			return nil
+		}
+		data = data[4:]
+		if len(data) < length {
+			return fmt.Errorf("%w: option overruns its block", ErrPcapng)
+		}
+		fn(code, data[:length])
+		padded := (length + 3) &^ 3
+		if padded > len(data) {
+			padded = len(data)
+		}
+		data = data[padded:]
+	}
+	return nil
+}
+
+// Starts a new section, given the body of its header after the byte order
+// magic. Interfaces are numbered afresh in each section.
+func (pr *PcapngReader) startSection(body []byte) error {
+	if major := pr.order.Uint16(body[0:2]); major != 1 {
+		return fmt.Errorf("%w: unsupported version %d", ErrPcapng, major)
+	}
+	pr.section = len(pr.interfaces)
+	// Skip the version and the section length.
+	return pr.options(body[12:], func(code uint16, value []byte) {
+		if code == OPT_COMMENT {
+			pr.comments = append(pr.comments, string(value))
+		}
+	})
+}
+
+// Adds the interface described by the body of an IDB.
+func (pr *PcapngReader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("%w: short interface description", ErrPcapng)
+	}
+	ifc := &PcapngInterface{
+		LinkType:  LinkType(pr.order.Uint16(body[0:2])),
+		SnapLen:   int(pr.order.Uint32(body[4:8])),
+		Received:  -1,
+		IfDropped: -1,
+		OSDropped: -1,
+		Accepted:  -1,
+		units:     1000000,
+	}
+	var err error
+	perr := pr.options(body[8:], func(code uint16, value []byte) {
+		switch code {
+		case OPT_COMMENT:
+			ifc.Comments = append(ifc.Comments, string(value))
+		case IF_NAME:
+			ifc.Name = string(value)
+		case IF_DESCRIPTION:
+			ifc.Description = string(value)
+		case IF_TSRESOL:
+			if len(value) < 1 {
+				return
+			}
+			// The high bit picks a power of two instead of ten.
+			exp := uint64(value[0] & 0x7f)
+			if value[0]&0x80 != 0 {
+				if exp > 63 {
+					err = fmt.Errorf("%w: timestamp resolution 2^-%d",
+						ErrPcapng, exp)
+					return
+				}
+				ifc.units = 1 << exp
+				return
+			}
+			if exp > 19 {
+				err = fmt.Errorf("%w: timestamp resolution 10^-%d",
+					ErrPcapng, exp)
+				return
+			}
+			ifc.units = 1
+			for i := uint64(0); i < exp; i++ {
+				ifc.units *= 10
+			}
+		case IF_TSOFFSET:
+			if len(value) == 8 {
+				ifc.offset = int64(pr.order.Uint64(value))
+			}
+		}
+	})
+	if perr != nil {
+		return perr
+	}
+	if err != nil {
+		return err
+	}
+	pr.interfaces = append(pr.interfaces, ifc)
+	return nil
+}
+
+// Returns the interface with the given ID in the current section.
+func (pr *PcapngReader) lookup(id uint32) (int, *PcapngInterface, error) {
+	index := pr.section + int(id)
+	if id >= uint32(len(pr.interfaces)-pr.section) {
+		return 0, nil, fmt.Errorf("%w: packet on undescribed interface %d",
+			ErrPcapng, id)
+	}
+	return index, pr.interfaces[index], nil
+}
+
+// Converts a timestamp in the units of an interface to a time.
+func (ifc *PcapngInterface) time(ts uint64) time.Time {
+	secs := ts / ifc.units
+	frac := ts % ifc.units
+	// frac * 1e9 may not fit in 64 bits for fine resolutions.
+	hi, lo := bits.Mul64(frac, uint64(time.Second))
+	nsecs, _ := bits.Div64(hi, lo, ifc.units)
+	return time.Unix(int64(secs)+ifc.offset, int64(nsecs))
+}
+
+// Records the statistics in the body of an ISB.
+func (pr *PcapngReader) addStatistics(body []byte) error {
+	if len(body) < 12 {
+		return fmt.Errorf("%w: short interface statistics", ErrPcapng)
+	}
+	_, ifc, err := pr.lookup(pr.order.Uint32(body[0:4]))
+	if err != nil {
+		return err
+	}
+	return pr.options(body[12:], func(code uint16, value []byte) {
+		if len(value) != 8 {
+			return
+		}
+		count := int64(pr.order.Uint64(value))
+		switch code {
+		case ISB_IFRECV:
+			ifc.Received = count
+		case ISB_IFDROP:
+			ifc.IfDropped = count
+		case ISB_FILTERACCEPT:
+			ifc.Accepted = count
+		case ISB_OSDROP:
+			ifc.OSDropped = count
+		}
+	})
+}
+
+// Builds a packet from the captured data of a packet block, and the options
+// which follow it.
+func (pr *PcapngReader) packet(index int, ifc *PcapngInterface, ts uint64,
+	length int, data []byte, opts []byte) (*RawPacket, error) {
+	raw := &RawPacket{
+		Data:      append([]byte(nil), data...),
+		Time:      ifc.time(ts),
+		Length:    length,
+		LinkType:  ifc.LinkType,
+		Interface: index,
+	}
+	err := pr.options(opts, func(code uint16, value []byte) {
+		switch code {
+		case OPT_COMMENT:
+			raw.Comment = string(value)
+		case EPB_DROPCOUNT:
+			if len(value) == 8 {
+				ifc.Dropped += int64(pr.order.Uint64(value))
+			}
+		}
+	})
+	return raw, err
+}
+
+// Returns the captured data of a packet block and the options after it,
+// given the body from the captured length on.
+func split(body []byte, caplen int) ([]byte, []byte, error) {
+	padded := (caplen + 3) &^ 3
+	if caplen < 0 || padded > len(body) {
+		return nil, nil, fmt.Errorf("%w: captured length %d overruns its "+
+			"block", ErrPcapng, caplen)
+	}
+	return body[:caplen], body[padded:], nil
+}
+
+// Reads the next packet. Interface descriptions, statistics and comments
+// found on the way are recorded, and blocks of other types are skipped.
+func (pr *PcapngReader) ReadPacket() (*RawPacket, error) {
+	for {
+		kind, body, err := pr.readBlock()
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case PCAPNG_SHB:
+			err = pr.startSection(body)
+		case PCAPNG_IDB:
+			err = pr.addInterface(body)
+		case PCAPNG_ISB:
+			err = pr.addStatistics(body)
+		case PCAPNG_EPB:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("%w: short packet block", ErrPcapng)
+			}
+			index, ifc, err := pr.lookup(pr.order.Uint32(body[0:4]))
+			if err != nil {
+				return nil, err
+			}
+			ts := uint64(pr.order.Uint32(body[4:8]))<<32 |
+				uint64(pr.order.Uint32(body[8:12]))
+			caplen := int(pr.order.Uint32(body[12:16]))
+			length := int(pr.order.Uint32(body[16:20]))
+			data, opts, err := split(body[20:], caplen)
+			if err != nil {
+				return nil, err
+			}
+			return pr.packet(index, ifc, ts, length, data, opts)
+		case PCAPNG_PB:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("%w: short packet block", ErrPcapng)
+			}
+			index, ifc, err := pr.lookup(uint32(pr.order.Uint16(body[0:2])))
+			if err != nil {
+				return nil, err
+			}
+			ifc.Dropped += int64(pr.order.Uint16(body[2:4]))
+			ts := uint64(pr.order.Uint32(body[4:8]))<<32 |
+				uint64(pr.order.Uint32(body[8:12]))
+			caplen := int(pr.order.Uint32(body[12:16]))
+			length := int(pr.order.Uint32(body[16:20]))
+			data, opts, err := split(body[20:], caplen)
+			if err != nil {
+				return nil, err
+			}
+			return pr.packet(index, ifc, ts, length, data, opts)
+		case PCAPNG_SPB:
+			// Simple packets have no timestamp, and are always captured on
+			// the first interface of the section.
+			if len(body) < 4 {
+				return nil, fmt.Errorf("%w: short packet block", ErrPcapng)
+			}
+			index, ifc, err := pr.lookup(0)
+			if err != nil {
+				return nil, err
+			}
+			length := int(pr.order.Uint32(body[0:4]))
+			caplen := length
+			if ifc.SnapLen > 0 && caplen > ifc.SnapLen {
+				caplen = ifc.SnapLen
+			}
+			if caplen > len(body)-4 {
+				caplen = len(body) - 4
+			}
+			return pr.packet(index, ifc, 0, length, body[4:4+caplen], nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
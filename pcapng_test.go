@@ -0,0 +1,212 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// Writes pcapng blocks in the byte order of the current section.
+type pcapngWriter struct {
+	order binary.ByteOrder
+	buf   bytes.Buffer
+}
+
+func pad4(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Returns an option, padded to 32 bits.
+func (w *pcapngWriter) option(code uint16, value []byte) []byte {
+	b := make([]byte, 4)
+	w.order.PutUint16(b, code)
+	w.order.PutUint16(b[2:], uint16(len(value)))
+	return pad4(append(b, value...))
+}
+
+func (w *pcapngWriter) u32(v uint32) []byte {
+	b := make([]byte, 4)
+	w.order.PutUint32(b, v)
+	return b
+}
+
+func (w *pcapngWriter) u64(v uint64) []byte {
+	b := make([]byte, 8)
+	w.order.PutUint64(b, v)
+	return b
+}
+
+// Writes a block with the given body, and options if any are given.
+func (w *pcapngWriter) block(kind uint32, body []byte, options ...[]byte) {
+	body = pad4(body)
+	if len(options) > 0 {
+		body = append(cat(append([][]byte{body}, options...)...),
+			0, 0, 0, 0)
+	}
+	length := w.u32(uint32(len(body) + 12))
+	w.buf.Write(cat(w.u32(kind), length, body, length))
+}
+
+// Starts a section in the given byte order.
+func (w *pcapngWriter) section(order binary.ByteOrder, comment string) {
+	w.order = order
+	b := cat(w.u32(PCAPNG_BYTE_ORDER), []byte{0, 0, 0, 0},
+		bytes.Repeat([]byte{0xff}, 8))
+	w.order.PutUint16(b[4:], 1)
+	w.block(PCAPNG_SHB, b, w.option(OPT_COMMENT, []byte(comment)))
+}
+
+func (w *pcapngWriter) iface(link LinkType, name string,
+	options ...[]byte) {
+	b := make([]byte, 8)
+	w.order.PutUint16(b, uint16(link))
+	w.order.PutUint32(b[4:], 65535)
+	options = append([][]byte{w.option(IF_NAME, []byte(name))}, options...)
+	w.block(PCAPNG_IDB, b, options...)
+}
+
+func (w *pcapngWriter) packet(id uint32, ts uint64, data []byte,
+	options ...[]byte) {
+	b := cat(w.u32(id), w.u32(uint32(ts>>32)), w.u32(uint32(ts)),
+		w.u32(uint32(len(data))), w.u32(uint32(len(data))), data)
+	w.block(PCAPNG_EPB, b, options...)
+}
+
+func (w *pcapngWriter) stats(id uint32, received, dropped uint64) {
+	b := cat(w.u32(id), make([]byte, 8))
+	w.block(PCAPNG_ISB, b, w.option(ISB_IFRECV, w.u64(received)),
+		w.option(ISB_IFDROP, w.u64(dropped)))
+}
+
+// Returns a file of two sections, the first little endian with three
+// interfaces and the second big endian with one.
+func pcapngFile() []byte {
+	ip := ip4("10.0.0.1", "10.0.0.2", IP_UDP, udp(1000, 53, 5))
+	w := &pcapngWriter{}
+	w.section(binary.LittleEndian, "first")
+	w.iface(LINKTYPE_ETHERNET, "eth0")
+	// Nanoseconds, as 10^-9.
+	w.iface(LINKTYPE_RAW, "tun0", w.option(IF_TSRESOL, []byte{9}))
+	// 1/1024ths of a second, as 2^-10, starting 100s after the epoch.
+	w.iface(LINKTYPE_LOOP, "lo", w.option(IF_TSRESOL, []byte{0x80 | 10}),
+		w.option(IF_TSOFFSET, w.u64(100)))
+	w.packet(0, 1500000000123456, ether(ETHERTYPE_IP, ip),
+		w.option(OPT_COMMENT, []byte("on eth0")),
+		w.option(EPB_DROPCOUNT, w.u64(3)))
+	w.packet(1, 1500000000123456789, ip)
+	w.packet(2, 3*1024+512, cat([]byte{0, 0, 0, 2}, ip))
+	w.stats(0, 100, 7)
+	w.section(binary.BigEndian, "second")
+	// Milliseconds, starting 1000s before the epoch.
+	w.iface(LINKTYPE_RAW, "eth1", w.option(IF_TSRESOL, []byte{3}),
+		w.option(IF_TSOFFSET, w.u64(uint64(1<<64-1000))))
+	w.packet(0, 2000250, ip)
+	w.stats(0, 1, 0)
+	return w.buf.Bytes()
+}
+
+func TestPcapng(t *testing.T) {
+	want := []struct {
+		iface int
+		link  LinkType
+		time  time.Time
+	}{
+		{0, LINKTYPE_ETHERNET, time.Unix(1500000000, 123456000)},
+		{1, LINKTYPE_RAW, time.Unix(1500000000, 123456789)},
+		{2, LINKTYPE_LOOP, time.Unix(103, 500000000)},
+		{3, LINKTYPE_RAW, time.Unix(1000, 250000000)},
+	}
+	file := pcapngFile()
+	r, err := NewPcapngReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range want {
+		raw, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if raw.Interface != w.iface || raw.LinkType != w.link ||
+			!raw.Time.Equal(w.time) {
+			t.Errorf("packet %d: interface %d, link type %d, at %v", i,
+				raw.Interface, raw.LinkType, raw.Time.UTC())
+		}
+		var p Packet
+		if err := p.DecodeRaw(raw); err != nil || p.DstPort != 53 ||
+			p.Interface != w.iface {
+			t.Errorf("packet %d: decoded %+v, %v", i, p, err)
+		}
+		if i == 0 && raw.Comment != "on eth0" {
+			t.Errorf("packet %d: comment %q", i, raw.Comment)
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("got %v after the last packet", err)
+	}
+	ifcs := r.Interfaces()
+	if len(ifcs) != 4 {
+		t.Fatalf("got %d interfaces", len(ifcs))
+	}
+	for i, name := range []string{"eth0", "tun0", "lo", "eth1"} {
+		if ifcs[i].Name != name {
+			t.Errorf("interface %d: named %s", i, ifcs[i].Name)
+		}
+	}
+	if ifcs[0].Received != 100 || ifcs[0].IfDropped != 7 ||
+		ifcs[0].Dropped != 3 || ifcs[0].OSDropped != -1 {
+		t.Errorf("eth0: got %+v", ifcs[0])
+	}
+	if ifcs[1].Received != -1 || ifcs[1].IfDropped != -1 {
+		t.Errorf("tun0: got %+v", ifcs[1])
+	}
+	if ifcs[3].Received != 1 || ifcs[3].IfDropped != 0 {
+		t.Errorf("eth1: got %+v", ifcs[3])
+	}
+	comments := r.Comments()
+	if len(comments) != 2 || comments[0] != "first" ||
+		comments[1] != "second" {
+		t.Errorf("got comments %q", comments)
+	}
+}
+
+func TestPcapngDamaged(t *testing.T) {
+	file := pcapngFile()
+	r, err := NewPcapngReader(bytes.NewReader(file[:len(file)-30]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for err == nil {
+		_, err = r.ReadPacket()
+	}
+	if !errors.Is(err, ErrPcapng) {
+		t.Errorf("got %v from a truncated file", err)
+	}
+	if _, err := NewPcapngReader(bytes.NewReader(nil)); err == nil {
+		t.Error("empty file accepted")
+	}
+}
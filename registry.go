@@ -0,0 +1,562 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Updates a feature of a flow with a packet.
+type featureHook func(f *Flow, ft Feature, pkt *Packet)
+
+// A feature of a flow, as declared in the registry.
+type featureDef struct {
+	name   string   // Names the exported columns, e.g. fpktl for min_fpktl
+	doc    string   // Describes the feature in the feature list
+	groups []string // The groups which select the feature, besides all
+	// The other features this one uses, which are computed along with it
+	// whether or not they are exported. They must come before it.
+	needs []string
+	// Creates the feature for a new flow. The type of the feature decides
+	// the columns it exports.
+	create func(cfg *Config) Feature
+	// Updates the feature with each packet of the flow, the first included.
+	// May be nil.
+	update featureHook
+	// Updates the feature with an ICMP error about a packet of the flow. May
+	// be nil.
+	icmpError featureHook
+	// Finalises the feature when the flow is exported. Features are
+	// finalised in registry order, so a feature may use those above it. May
+	// be nil.
+	finish func(f *Flow, ft Feature)
+	// Whether the feature is exported under a Config. Nil if always.
+	enabled func(cfg *Config) bool
+	// The setting which enables the feature, named in errors.
+	enabledBy string
+}
+
+// The columns which identify a flow, exported before its features.
+var flowKeys = []struct {
+	name  string
+	doc   string
+	value func(f *Flow) interface{}
+}{
+	{"srcip", "The IP address of the client",
+		func(f *Flow) interface{} { return f.srcip.String() }},
+	{"srcport", "The port of the client",
+		func(f *Flow) interface{} { return int64(f.srcport) }},
+	{"dstip", "The IP address of the server",
+		func(f *Flow) interface{} { return f.dstip.String() }},
+	{"dstport", "The port of the server",
+		func(f *Flow) interface{} { return int64(f.dstport) }},
+	{"proto", "The IP protocol number",
+		func(f *Flow) interface{} { return int64(f.proto) }},
+}
+
+// The features of a flow, in the order they are exported. To add a feature,
+// declare it here: how it is created, and how it is updated by each packet
+// and finalised on export. Its columns, and the feature list, follow from the
+// declaration. Packets sent by the client (the sender of the first packet of
+// the flow) are forward, and those sent by the server backward.
+var features = []featureDef{
+	{name: "total_fpackets", doc: "The number of forward packets",
+		groups: []string{"basic"},
+		create: newValue, update: count(P_FORWARD, always)},
+	{name: "total_fvolume", doc: "The bytes of the forward packets",
+		groups: []string{"basic"},
+		create: newValue, update: each(P_FORWARD, packetLength)},
+	{name: "total_bpackets", doc: "The number of backward packets",
+		groups: []string{"basic"},
+		create: newValue, update: count(P_BACKWARD, always)},
+	{name: "total_bvolume", doc: "The bytes of the backward packets",
+		groups: []string{"basic"},
+		create: newValue, update: each(P_BACKWARD, packetLength)},
+	{name: "fpktl", doc: "The lengths of the forward packets",
+		groups: []string{"lengths"},
+		create: newQuantile, update: each(P_FORWARD, packetLength)},
+	{name: "bpktl", doc: "The lengths of the backward packets",
+		groups: []string{"lengths"},
+		create: newQuantile, update: each(P_BACKWARD, packetLength)},
+	{name: "fiat", doc: "The times between forward packets",
+		groups: []string{"timing"},
+		create: newTimeQuantile, update: interArrival(P_FORWARD)},
+	{name: "biat", doc: "The times between backward packets",
+		groups: []string{"timing"},
+		create: newTimeQuantile, update: interArrival(P_BACKWARD)},
+	{name: "duration", doc: "The time from the first packet to the last",
+		groups: []string{"basic", "timing"},
+		create: newTimeValue,
+		finish: func(f *Flow, ft Feature) {
+			ft.Set(f.getLastTime() - f.firstTime)
+		}},
+	{name: "active", doc: "The times the flow was active before going idle",
+		groups: []string{"timing"},
+		create: newTimeQuantile,
+		update: func(f *Flow, ft Feature, pkt *Packet) {
+			if f.idle > 0 {
+				ft.Add(f.active)
+			}
+		},
+		finish: func(f *Flow, ft Feature) {
+			// The flow is active until its last packet.
+			ft.Add(f.getLastTime() - f.activeStart)
+		}},
+	{name: "idle", doc: "The times the flow was idle before becoming active",
+		groups: []string{"timing"},
+		create: newTimeQuantile,
+		update: func(f *Flow, ft Feature, pkt *Packet) {
+			if f.idle > 0 {
+				ft.Add(f.idle)
+			}
+		}},
+	{name: "sflow_fpackets",
+		doc:    "The average number of forward packets in an active time",
+		groups: []string{"subflows"},
+		needs:  []string{"active", "total_fpackets"},
+		create: newValue, finish: subflow("total_fpackets")},
+	{name: "sflow_fbytes",
+		doc:    "The average bytes of forward packets in an active time",
+		groups: []string{"subflows"},
+		needs:  []string{"active", "total_fvolume"},
+		create: newValue, finish: subflow("total_fvolume")},
+	{name: "sflow_bpackets",
+		doc:    "The average number of backward packets in an active time",
+		groups: []string{"subflows"},
+		needs:  []string{"active", "total_bpackets"},
+		create: newValue, finish: subflow("total_bpackets")},
+	{name: "sflow_bbytes",
+		doc:    "The average bytes of backward packets in an active time",
+		groups: []string{"subflows"},
+		needs:  []string{"active", "total_bvolume"},
+		create: newValue, finish: subflow("total_bvolume")},
+	{name: "fpsh_cnt", doc: "The number of forward packets with PSH set",
+		groups: []string{"tcp-flags"},
+		create: newValue, update: count(P_FORWARD, tcpFlag(TCP_PSH))},
+	{name: "bpsh_cnt", doc: "The number of backward packets with PSH set",
+		groups: []string{"tcp-flags"},
+		create: newValue, update: count(P_BACKWARD, tcpFlag(TCP_PSH))},
+	{name: "furg_cnt", doc: "The number of forward packets with URG set",
+		groups: []string{"tcp-flags"},
+		create: newValue, update: count(P_FORWARD, tcpFlag(TCP_URG))},
+	{name: "burg_cnt", doc: "The number of backward packets with URG set",
+		groups: []string{"tcp-flags"},
+		create: newValue, update: count(P_BACKWARD, tcpFlag(TCP_URG))},
+	{name: "total_fhlen", doc: "The bytes of headers of the forward packets",
+		groups: []string{"lengths"},
+		create: newValue, update: each(P_FORWARD, headerLength)},
+	{name: "total_bhlen", doc: "The bytes of headers of the backward packets",
+		groups: []string{"lengths"},
+		create: newValue, update: each(P_BACKWARD, headerLength)},
+	{name: "dscp", doc: "The first DSCP value set in the flow",
+		groups: []string{"basic"},
+		create: newValue,
+		update: func(f *Flow, ft Feature, pkt *Packet) {
+			if ft.Get() == 0 {
+				ft.Set(int64(pkt.DSCP))
+			}
+		}},
+	{name: "icmp_echo_req", doc: "The number of ICMP echo requests",
+		groups: []string{"icmp"},
+		create: newValue,
+		update: func(f *Flow, ft Feature, pkt *Packet) {
+			if f.isIcmp() && pkt.IsEchoRequest() {
+				ft.Add(1)
+			}
+		}},
+	{name: "icmp_echo_rep", doc: "The number of ICMP echo replies",
+		groups: []string{"icmp"},
+		create: newValue,
+		update: func(f *Flow, ft Feature, pkt *Packet) {
+			if f.isIcmp() && pkt.IsEchoReply() {
+				ft.Add(1)
+			}
+		}},
+	{name: "icmp_unreach",
+		groups: []string{"icmp"},
+		doc:    "The number of ICMP destination unreachable messages",
+		create: newValue, update: icmpErrors(countUnreachable),
+		icmpError: countUnreachable},
+	{name: "icmp_err", doc: "The number of other ICMP error messages",
+		groups: []string{"icmp"},
+		create: newValue, update: icmpErrors(countIcmpError),
+		icmpError: countIcmpError},
+	{name: "icmp_rtt", doc: "The round trip times of ICMP echo requests",
+		groups: []string{"icmp"},
+		create: newTimeDistribution, update: echoRtt},
+	{name: "frag_cnt",
+		groups: []string{"fragments"},
+		doc:    "The number of IP fragments the packets were reassembled from",
+		create: newValue,
+		update: func(f *Flow, ft Feature, pkt *Packet) {
+			ft.Add(pkt.Fragments)
+		}},
+	{name: "frag_evasive",
+		groups: []string{"fragments"},
+		doc:    "The number of packets reassembled from overlapping fragments",
+		create: newValue,
+		update: func(f *Flow, ft Feature, pkt *Packet) {
+			if pkt.Evasive {
+				ft.Add(1)
+			}
+		}},
+	{name: "fpktl_hist", doc: "A histogram of the forward packet lengths",
+		groups: []string{"lengths", "histograms"},
+		create: newLengthHistogram, update: each(P_FORWARD, packetLength)},
+	{name: "bpktl_hist", doc: "A histogram of the backward packet lengths",
+		groups: []string{"lengths", "histograms"},
+		create: newLengthHistogram, update: each(P_BACKWARD, packetLength)},
+	{name: "fiat_hist",
+		groups: []string{"timing", "histograms"},
+		doc:    "A histogram of the times between forward packets",
+		create: newIatHistogram, update: interArrival(P_FORWARD)},
+	{name: "biat_hist",
+		groups: []string{"timing", "histograms"},
+		doc:    "A histogram of the times between backward packets",
+		create: newIatHistogram, update: interArrival(P_BACKWARD)},
+	{name: "vlan", doc: "The VLAN ID of the flow, or 0",
+		groups: []string{"encap"},
+		create: newValue,
+		finish: func(f *Flow, ft Feature) { ft.Set(int64(f.vlan)) }},
+	{name: "inner_vlan", doc: "The inner VLAN ID of a QinQ flow, or 0",
+		groups: []string{"encap"},
+		create: newValue,
+		finish: func(f *Flow, ft Feature) { ft.Set(int64(f.innerVlan)) }},
+	{name: "tunnel_id", doc: "The ID of the tunnel the flow was found in, or 0",
+		groups: []string{"encap"},
+		create: newValue,
+		finish: func(f *Flow, ft Feature) { ft.Set(int64(f.tunnelID)) }},
+	{name: "iface", doc: "The capture interface of the first packet",
+		create:    newValue,
+		finish:    func(f *Flow, ft Feature) { ft.Set(int64(f.iface)) },
+		enabled:   func(cfg *Config) bool { return cfg.ExportInterface },
+		enabledBy: "ExportInterface"},
+}
+
+// The position of each feature in the registry, by name.
+var featureIndex = make(map[string]int)
+
+// The positions of the features in each group, by the name of the group.
+var featureGroups = make(map[string][]int)
+
+// The group which selects every feature.
+const ALL_FEATURES = "all"
+
+func init() {
+	for i, def := range features {
+		if _, ok := featureIndex[def.name]; ok {
+			panic("feature registered twice: " + def.name)
+		}
+		for _, need := range def.needs {
+			if _, ok := featureIndex[need]; !ok {
+				panic(def.name + " needs a feature before it: " + need)
+			}
+		}
+		featureIndex[def.name] = i
+		for _, group := range def.groups {
+			featureGroups[group] = append(featureGroups[group], i)
+		}
+	}
+	for group := range featureGroups {
+		if _, ok := featureIndex[group]; ok || group == ALL_FEATURES {
+			panic("group named after a feature: " + group)
+		}
+	}
+}
+
+// Which of the registered features a flow computes, and which it exports.
+type featureLayout struct {
+	computed []bool
+	exported []bool
+}
+
+// Works out the features of flows under cfg: those selected and enabled are
+// exported, and computed along with the features they need. Names which are
+// not registered select nothing, and are reported by Config.Validate.
+func newLayout(cfg *Config) *featureLayout {
+	l := &featureLayout{
+		computed: make([]bool, len(features)),
+		exported: make([]bool, len(features)),
+	}
+	selected := make(map[string]bool)
+	for _, name := range cfg.ExportFeatures {
+		selected[name] = true
+	}
+	var compute func(i int)
+	compute = func(i int) {
+		l.computed[i] = true
+		for _, need := range features[i].needs {
+			compute(featureIndex[need])
+		}
+	}
+	for i, def := range features {
+		if (cfg.ExportFeatures == nil || selected[def.name]) &&
+			def.isEnabled(cfg) {
+			l.exported[i] = true
+			compute(i)
+		}
+	}
+	return l
+}
+
+// Returns the names of the features selected by a comma separated list of
+// feature names and groups, in export order. A name or group prefixed with -
+// is left out. The list is applied from left to right, starting from every
+// feature if it begins by leaving some out, so that "basic,tcp-flags" selects
+// two groups and "-histograms,-icmp" every feature but two groups. An empty
+// list selects every feature, and gives nil. Groups and "every feature" only
+// take in the features enabled under cfg, and naming a feature which is not
+// enabled, or leaving out every feature, is an error.
+func (cfg *Config) SelectFeatures(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	selected := make([]bool, len(features))
+	for n, term := range strings.Split(list, ",") {
+		term = strings.TrimSpace(term)
+		include := !strings.HasPrefix(term, "-")
+		term = strings.TrimPrefix(term, "-")
+		if n == 0 && !include {
+			for i, def := range features {
+				selected[i] = def.isEnabled(cfg)
+			}
+		}
+		var indexes []int
+		if i, ok := featureIndex[term]; ok {
+			if include && !features[i].isEnabled(cfg) {
+				return nil, features[i].disabledError()
+			}
+			indexes = []int{i}
+		} else if group, ok := featureGroups[term]; ok {
+			indexes = group
+		} else if term == ALL_FEATURES {
+			for i := range features {
+				indexes = append(indexes, i)
+			}
+		} else {
+			return nil, fmt.Errorf("no feature or group named %q", term)
+		}
+		for _, i := range indexes {
+			selected[i] = include && features[i].isEnabled(cfg)
+		}
+	}
+	var names []string
+	for i, ok := range selected {
+		if ok {
+			names = append(names, features[i].name)
+		}
+	}
+	if names == nil {
+		return nil, fmt.Errorf("%q selects no features", list)
+	}
+	return names, nil
+}
+
+// Returns whether the feature is exported under cfg when selected.
+func (def *featureDef) isEnabled(cfg *Config) bool {
+	return def.enabled == nil || def.enabled(cfg)
+}
+
+// Returns the error for selecting a feature which is not enabled.
+func (def *featureDef) disabledError() error {
+	return fmt.Errorf("feature %q needs %s", def.name, def.enabledBy)
+}
+
+// Feature constructors.
+
+func newValue(cfg *Config) Feature {
+	return new(ValueFeature)
+}
+
+func newTimeValue(cfg *Config) Feature {
+	return &ValueFeature{unit: cfg.TimeUnit.Microseconds()}
+}
+
+func newQuantile(cfg *Config) Feature {
+	return NewQuantileFeature(0)
+}
+
+func newTimeQuantile(cfg *Config) Feature {
+	return NewQuantileFeature(cfg.TimeUnit.Microseconds())
+}
+
+func newTimeDistribution(cfg *Config) Feature {
+	return &DistributionFeature{unit: cfg.TimeUnit.Microseconds()}
+}
+
+func newLengthHistogram(cfg *Config) Feature {
+	return NewHistogramFeature(cfg.LengthBins)
+}
+
+func newIatHistogram(cfg *Config) Feature {
+	return NewHistogramFeature(cfg.IatBins)
+}
+
+// Update hooks.
+
+func always(f *Flow, pkt *Packet) bool {
+	return true
+}
+
+func packetLength(f *Flow, pkt *Packet) int64 {
+	return pkt.Len
+}
+
+func headerLength(f *Flow, pkt *Packet) int64 {
+	return pkt.IPHLen + pkt.PrHLen
+}
+
+// Returns a condition which holds for TCP packets with the given flag set.
+func tcpFlag(flag uint8) func(f *Flow, pkt *Packet) bool {
+	return func(f *Flow, pkt *Packet) bool {
+		return f.proto == IP_TCP && tcpSet(flag, pkt.Flags)
+	}
+}
+
+// Returns a hook which counts the packets sent in a direction for which cond
+// holds.
+func count(dir int8, cond func(f *Flow, pkt *Packet) bool) featureHook {
+	return func(f *Flow, ft Feature, pkt *Packet) {
+		if f.pdir == dir && cond(f, pkt) {
+			ft.Add(1)
+		}
+	}
+}
+
+// Returns a hook which adds a value of each packet sent in a direction.
+func each(dir int8, value func(f *Flow, pkt *Packet) int64) featureHook {
+	return func(f *Flow, ft Feature, pkt *Packet) {
+		if f.pdir == dir {
+			ft.Add(value(f, pkt))
+		}
+	}
+}
+
+// Returns a hook which adds the time since the previous packet in a
+// direction, within the same active time.
+func interArrival(dir int8) featureHook {
+	return func(f *Flow, ft Feature, pkt *Packet) {
+		if f.pdir == dir && f.iat >= 0 {
+			ft.Add(f.iat)
+		}
+	}
+}
+
+// Returns a hook which counts the ICMP errors of an ICMP flow with hook.
+func icmpErrors(hook featureHook) featureHook {
+	return func(f *Flow, ft Feature, pkt *Packet) {
+		if f.isIcmp() {
+			hook(f, ft, pkt)
+		}
+	}
+}
+
+func countUnreachable(f *Flow, ft Feature, pkt *Packet) {
+	if pkt.IsUnreachable() {
+		ft.Add(1)
+	}
+}
+
+func countIcmpError(f *Flow, ft Feature, pkt *Packet) {
+	if !pkt.IsUnreachable() && pkt.IsIcmpError() {
+		ft.Add(1)
+	}
+}
+
+// Measures the round trip time of ICMP echo requests, by matching replies to
+// requests by sequence number.
+func echoRtt(f *Flow, ft Feature, pkt *Packet) {
+	if !f.isIcmp() {
+		return
+	}
+	switch {
+	case pkt.IsEchoRequest():
+		if f.echoes == nil {
+			f.echoes = make(map[uint16]int64)
+		}
+		if len(f.echoes) < ICMP_MAX_PENDING {
+			f.echoes[pkt.IcmpSeq] = pkt.Time
+		}
+	case pkt.IsEchoReply():
+		if sent, ok := f.echoes[pkt.IcmpSeq]; ok {
+			ft.Add(pkt.Time - sent)
+			delete(f.echoes, pkt.IcmpSeq)
+		}
+	}
+}
+
+// Finalise hooks.
+
+// Returns a hook which sets a feature to the average of a total over the
+// active times of the flow.
+func subflow(total string) func(f *Flow, ft Feature) {
+	return func(f *Flow, ft Feature) {
+		if n := f.get("active"); n > 0 {
+			ft.Set(f.get(total) / n)
+		}
+	}
+}
+
+// Returns the value of another feature of the flow.
+func (f *Flow) get(name string) int64 {
+	i, ok := featureIndex[name]
+	if !ok {
+		panic(fmt.Sprintf("no feature named %s", name))
+	}
+	return f.f[i].Get()
+}
+
+// Describes a flow key or feature, and the columns it is exported as.
+type FeatureDoc struct {
+	Name    string
+	Doc     string
+	Groups  []string // The groups which select the feature, besides all
+	Columns Record   // The columns, with values of their types
+}
+
+// Returns the flow keys and features exported under cfg, in column order.
+func (cfg *Config) Features() []FeatureDoc {
+	f := &Flow{cfg: cfg}
+	f.initFeatures()
+	var docs []FeatureDoc
+	for _, key := range flowKeys {
+		docs = append(docs, FeatureDoc{key.name, key.doc, nil,
+			Record{{key.name, key.value(f)}}})
+	}
+	for i, def := range features {
+		if f.layout.exported[i] {
+			docs = append(docs, FeatureDoc{def.name, def.doc, def.groups,
+				f.f[i].Export(def.name)})
+		}
+	}
+	return docs
+}
+
+// Returns the names of the groups features can be selected by, sorted.
+func FeatureGroups() []string {
+	groups := []string{ALL_FEATURES}
+	for group := range featureGroups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
@@ -0,0 +1,135 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSelectFeatures(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		err  bool
+	}{
+		{"", nil, false},
+		{"fpsh_cnt,tcp-flags,-furg_cnt", []string{"fpsh_cnt", "bpsh_cnt",
+			"burg_cnt"}, false},
+		{"-all,dscp", []string{"dscp"}, false},
+		{"-all", nil, true},
+		{"basic,-basic", nil, true},
+		{"basic,nope", nil, true},
+		// iface is only selected with ExportInterface.
+		{"iface", nil, true},
+		{"dscp,iface", nil, true},
+		{"-all,tunnel_id,-iface", []string{"tunnel_id"}, false},
+	}
+	for _, test := range tests {
+		names, err := DefaultConfig.SelectFeatures(test.list)
+		if (err != nil) != test.err || !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%q: got %v, %v", test.list, names, err)
+		}
+	}
+	cfg := DefaultConfig
+	cfg.ExportInterface = true
+	for list, want := range map[string]int{"iface": 1, "all": len(features),
+		"-histograms": len(features) - 4} {
+		names, err := cfg.SelectFeatures(list)
+		if err != nil || len(names) != want {
+			t.Errorf("%q with ExportInterface: got %v, %v", list, names, err)
+		}
+	}
+	names, _ := DefaultConfig.SelectFeatures("-histograms")
+	if len(names) != len(features)-5 {
+		t.Errorf("\"-histograms\": got %v", names)
+	}
+}
+
+// The features of earlier versions keep their order, before any added since.
+func TestFeatureOrder(t *testing.T) {
+	want := []string{"total_fpackets", "total_fvolume", "total_bpackets",
+		"total_bvolume", "fpktl", "bpktl", "fiat", "biat", "duration",
+		"active", "idle", "sflow_fpackets", "sflow_fbytes", "sflow_bpackets",
+		"sflow_bbytes", "fpsh_cnt", "bpsh_cnt", "furg_cnt", "burg_cnt",
+		"total_fhlen", "total_bhlen", "dscp"}
+	var got []string
+	for _, def := range features[:len(want)] {
+		got = append(got, def.name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(cfg *Config)
+		ok   bool
+	}{
+		{"default", func(cfg *Config) {}, true},
+		{"features", func(cfg *Config) {
+			cfg.ExportFeatures = []string{"fpktl", "dscp"}
+		}, true},
+		{"no features", func(cfg *Config) {
+			cfg.ExportFeatures = []string{}
+		}, false},
+		{"unknown feature", func(cfg *Config) {
+			cfg.ExportFeatures = []string{"fpktl", "nope"}
+		}, false},
+		{"flow timeout", func(cfg *Config) { cfg.FlowTimeout = 0 }, false},
+		{"idle threshold", func(cfg *Config) { cfg.IdleThreshold = -1 }, false},
+		{"linear bins", func(cfg *Config) {
+			cfg.LengthBins = LinearBins(0, 1500, 10)
+		}, true},
+		{"empty linear bins", func(cfg *Config) {
+			cfg.LengthBins = LinearBins(0, 1500, 0)
+		}, false},
+		{"reversed log bins", func(cfg *Config) {
+			cfg.IatBins = LogBins(1000, 10, 3)
+		}, false},
+		{"log bins from zero", func(cfg *Config) {
+			cfg.IatBins = LogBins(0, 10, 3)
+		}, false},
+		{"unordered edges", func(cfg *Config) {
+			cfg.LengthBins = EdgeBins(64, 64, 128)
+		}, false},
+		{"NaN edge", func(cfg *Config) {
+			cfg.LengthBins = EdgeBins(math.NaN())
+		}, false},
+		{"disabled feature", func(cfg *Config) {
+			cfg.ExportFeatures = []string{"dscp", "iface"}
+		}, false},
+		{"enabled feature", func(cfg *Config) {
+			cfg.ExportFeatures = []string{"dscp", "iface"}
+			cfg.ExportInterface = true
+		}, true},
+	}
+	for _, test := range tests {
+		cfg := DefaultConfig
+		test.edit(&cfg)
+		table, err := NewFlowTable(cfg, func(*Flow) {})
+		if (err == nil) != test.ok || (table != nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+// SCTP chunk types
+const (
+	SCTP_DATA              = 0
+	SCTP_INIT              = 1
+	SCTP_INIT_ACK          = 2
+	SCTP_SACK              = 3
+	SCTP_HEARTBEAT         = 4
+	SCTP_HEARTBEAT_ACK     = 5
+	SCTP_ABORT             = 6
+	SCTP_SHUTDOWN          = 7
+	SCTP_SHUTDOWN_ACK      = 8
+	SCTP_ERROR             = 9
+	SCTP_COOKIE_ECHO       = 10
+	SCTP_COOKIE_ACK        = 11
+	SCTP_SHUTDOWN_COMPLETE = 14
+)
+
+const (
+	SCTP_STATE_START = iota
+	SCTP_STATE_INIT
+	SCTP_STATE_INIT_ACK
+	SCTP_STATE_COOKIE_ECHOED
+	SCTP_STATE_ESTABLISHED
+	SCTP_STATE_SHUTDOWN
+	SCTP_STATE_CLOSED
+)
+
+// The state of an SCTP association, as seen from the packets of both
+// endpoints.
+type sctpState struct {
+	State uint8
+}
+
+// Returns whether a chunk of the given type is in the set of chunk types.
+func sctpSet(chunk uint8, chunks uint32) bool {
+	return chunk < 32 && chunks&(1<<chunk) != 0
+}
+
+// Updates the state of the association with the chunk types of a packet. dir
+// is the direction of the endpoint which started the association, and pdir
+// the direction of the packet.
+func (s *sctpState) SctpUpdate(chunks uint32, dir int8, pdir int8) {
+	if sctpSet(SCTP_ABORT, chunks) || sctpSet(SCTP_SHUTDOWN_COMPLETE, chunks) {
+		s.State = SCTP_STATE_CLOSED
+		return
+	}
+	if sctpSet(SCTP_SHUTDOWN, chunks) || sctpSet(SCTP_SHUTDOWN_ACK, chunks) {
+		s.State = SCTP_STATE_SHUTDOWN
+		return
+	}
+	// Chunks may be bundled, e.g. DATA with COOKIE ECHO, so the handshake can
+	// move on more than one step in a packet.
+	if s.State == SCTP_STATE_START {
+		if sctpSet(SCTP_INIT, chunks) && (dir == pdir) {
+			s.State = SCTP_STATE_INIT
+		}
+	}
+	if s.State == SCTP_STATE_INIT {
+		if sctpSet(SCTP_INIT_ACK, chunks) && (dir != pdir) {
+			s.State = SCTP_STATE_INIT_ACK
+		}
+	}
+	if s.State == SCTP_STATE_INIT_ACK {
+		if sctpSet(SCTP_COOKIE_ECHO, chunks) && (dir == pdir) {
+			s.State = SCTP_STATE_COOKIE_ECHOED
+		}
+	}
+	if s.State == SCTP_STATE_COOKIE_ECHOED {
+		if sctpSet(SCTP_COOKIE_ACK, chunks) && (dir != pdir) {
+			s.State = SCTP_STATE_ESTABLISHED
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// The relative accuracy of the quantiles of the sketches kept for flows.
+	SKETCH_ACCURACY = 0.01
+	// The most bins a sketch keeps for each sign. At 1% accuracy this covers
+	// values spanning about 17 orders of magnitude before the smallest values
+	// are merged.
+	SKETCH_MAX_BINS = 2048
+)
+
+// A DDSketch: a summary of a stream of values from which quantiles can be
+// estimated to within a relative error, in little memory. Values are counted
+// in bins whose widths grow geometrically, so that any value in a bin is
+// within the accuracy of the bin's representative value. Sketches with the
+// same accuracy can be merged.
+//
+// See Masson, Rim and Lee, "DDSketch: A Fast and Fully-Mergeable Quantile
+// Sketch with Relative-Error Guarantees", VLDB 2019.
+type DDSketch struct {
+	gamma    float64 // The ratio between the bounds of a bin
+	logGamma float64
+	pos      sketchStore // Positive values
+	neg      sketchStore // Negative values, by their magnitude
+	zeros    uint64
+	count    uint64
+}
+
+// Counts the values falling in a contiguous range of bins.
+type sketchStore struct {
+	offset int // The index of the first bin
+	bins   []uint32
+}
+
+// Creates an empty DDSketch whose quantiles are within the given relative
+// accuracy (e.g. 0.01 for 1%) of the true values.
+func NewDDSketch(accuracy float64) *DDSketch {
+	if accuracy <= 0 || accuracy >= 1 {
+		panic(fmt.Sprintf("bad sketch accuracy %g", accuracy))
+	}
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &DDSketch{gamma: gamma, logGamma: math.Log(gamma)}
+}
+
+// Returns the bin of a positive value.
+func (s *DDSketch) index(val float64) int {
+	return int(math.Ceil(math.Log(val) / s.logGamma))
+}
+
+// Returns the representative value of a bin.
+func (s *DDSketch) value(index int) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (s.gamma + 1)
+}
+
+// Adds a value to the sketch.
+func (s *DDSketch) Add(val float64) {
+	s.count++
+	switch {
+	case val > 0:
+		s.pos.add(s.index(val), 1)
+	case val < 0:
+		s.neg.add(s.index(-val), 1)
+	default:
+		s.zeros++
+	}
+}
+
+// Adds the values summarised by another sketch of the same accuracy.
+func (s *DDSketch) Merge(other *DDSketch) {
+	if other.gamma != s.gamma {
+		panic("merging sketches of different accuracies")
+	}
+	for i, n := range other.pos.bins {
+		s.pos.add(other.pos.offset+i, n)
+	}
+	for i, n := range other.neg.bins {
+		s.neg.add(other.neg.offset+i, n)
+	}
+	s.zeros += other.zeros
+	s.count += other.count
+}
+
+// Returns the number of values added.
+func (s *DDSketch) Count() uint64 {
+	return s.count
+}
+
+// Empties the sketch.
+func (s *DDSketch) Reset() {
+	*s = DDSketch{gamma: s.gamma, logGamma: s.logGamma}
+}
+
+// Returns an estimate of the q-quantile (e.g. 0.5 for the median) of the
+// values added, or 0 if there are none.
+func (s *DDSketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := q * float64(s.count-1)
+	var seen float64
+	// From the most negative values up.
+	for i := len(s.neg.bins) - 1; i >= 0; i-- {
+		seen += float64(s.neg.bins[i])
+		if seen > rank {
+			return -s.value(s.neg.offset + i)
+		}
+	}
+	seen += float64(s.zeros)
+	if seen > rank {
+		return 0
+	}
+	for i, n := range s.pos.bins {
+		seen += float64(n)
+		if seen > rank {
+			return s.value(s.pos.offset + i)
+		}
+	}
+	return s.value(s.pos.offset + len(s.pos.bins) - 1)
+}
+
+// Adds n to the count of a bin, growing the store to hold it. Once the store
+// would hold more than SKETCH_MAX_BINS bins, the lowest are merged.
+func (st *sketchStore) add(index int, n uint32) {
+	if len(st.bins) == 0 {
+		st.offset = index
+		st.bins = make([]uint32, 1, 8)
+	}
+	lo, hi := st.offset, st.offset+len(st.bins)
+	if index < lo {
+		lo = index
+	}
+	if index >= hi {
+		hi = index + 1
+	}
+	if hi-lo > SKETCH_MAX_BINS {
+		lo = hi - SKETCH_MAX_BINS
+		if index < lo {
+			index = lo
+		}
+	}
+	switch {
+	case lo == st.offset && hi <= st.offset+cap(st.bins):
+		// Fits in the spare capacity at the end.
+		st.bins = st.bins[:hi-lo]
+	case lo != st.offset || hi != st.offset+len(st.bins):
+		bins := make([]uint32, hi-lo, hi-lo+8)
+		for i, count := range st.bins {
+			j := st.offset + i - lo
+			if j < 0 {
+				j = 0
+			}
+			bins[j] += count
+		}
+		st.bins, st.offset = bins, lo
+	}
+	st.bins[index-st.offset] += n
+}
@@ -0,0 +1,161 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+package flowtbag
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Returns the exact q-quantile of sorted values, as ranked by DDSketch.
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestSketch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name  string
+		n     int
+		value func(i int) float64
+	}{
+		{"single", 1, func(i int) float64 { return 42 }},
+		{"constant", 1000, func(i int) float64 { return 1500 }},
+		{"uniform", 1000, func(i int) float64 { return float64(i + 1) }},
+		{"zeros", 1000, func(i int) float64 { return 0 }},
+		{"mostly zeros", 1000, func(i int) float64 {
+			if i%10 == 0 {
+				return float64(i)
+			}
+			return 0
+		}},
+		{"exponential", 10000, func(i int) float64 {
+			return r.ExpFloat64() * 1000
+		}},
+		{"lognormal", 10000, func(i int) float64 {
+			return math.Exp(r.NormFloat64() * 4)
+		}},
+		{"signed", 10000, func(i int) float64 {
+			return r.NormFloat64() * 1e6
+		}},
+	}
+	for _, test := range tests {
+		s := NewDDSketch(SKETCH_ACCURACY)
+		values := make([]float64, test.n)
+		for i := range values {
+			values[i] = test.value(i)
+			s.Add(values[i])
+		}
+		sort.Float64s(values)
+		for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+			want := exactQuantile(values, q)
+			got := s.Quantile(q)
+			if math.Abs(got-want) > SKETCH_ACCURACY*math.Abs(want)*1.0001 {
+				t.Errorf("%s: quantile %g is %g, want %g", test.name, q, got,
+					want)
+			}
+		}
+	}
+	if got := NewDDSketch(SKETCH_ACCURACY).Quantile(0.5); got != 0 {
+		t.Errorf("empty sketch: median %g", got)
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	a := NewDDSketch(SKETCH_ACCURACY)
+	b := NewDDSketch(SKETCH_ACCURACY)
+	var values []float64
+	for i := 0; i < 1000; i++ {
+		v := float64(i * i % 997)
+		values = append(values, v)
+		if i%3 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+	}
+	a.Merge(b)
+	sort.Float64s(values)
+	if a.Count() != 1000 {
+		t.Errorf("merged %d values", a.Count())
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		want := exactQuantile(values, q)
+		if got := a.Quantile(q); math.Abs(got-want) >
+			SKETCH_ACCURACY*want*1.0001 {
+			t.Errorf("quantile %g is %g, want %g", q, got, want)
+		}
+	}
+}
+
+// A flow of one packet has no inter-arrival or idle times, and exports their
+// quantiles as zeros.
+func TestQuantilesEmptyFlow(t *testing.T) {
+	var p Packet
+	frame := ether(ETHERTYPE_IP, ip4("10.0.0.1", "10.0.0.2", IP_UDP,
+		udp(1000, 53, 10)))
+	if err := p.Decode(frame, time.Unix(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig
+	var f Flow
+	f.Init(&p, &cfg)
+	rec := f.record()
+	for _, name := range []string{"fiat", "biat", "idle", "bpktl"} {
+		for _, q := range QUANTILES {
+			if v := field(rec, q.prefix+name); v != 0.0 {
+				t.Errorf("%s%s is %v", q.prefix, name, v)
+			}
+		}
+	}
+	for _, q := range QUANTILES {
+		if v := field(rec, q.prefix+"fpktl"); v != 38.0 {
+			t.Errorf("%sfpktl is %v", q.prefix, v)
+		}
+	}
+}
+
+func TestQuantileFeature(t *testing.T) {
+	// Times from 1ms to 100ms, exported in milliseconds.
+	f := NewQuantileFeature(1000)
+	for i := int64(1); i <= 100; i++ {
+		f.Add(i * 1000)
+	}
+	want := map[string]float64{"median_fiat": 50, "p90_fiat": 90,
+		"p99_fiat": 99}
+	rec := f.Export("fiat")
+	for name, w := range want {
+		v, _ := field(rec, name).(float64)
+		if math.Abs(v-w) > SKETCH_ACCURACY*w*1.0001 {
+			t.Errorf("%s is %v, want %v", name, v, w)
+		}
+	}
+	// Estimates are kept within the minimum and maximum.
+	f.Set(7000)
+	rec = f.Export("fiat")
+	for _, q := range QUANTILES {
+		if v := field(rec, q.prefix+"fiat"); v != 7.0 {
+			t.Errorf("%sfiat is %v after Set", q.prefix, v)
+		}
+	}
+}
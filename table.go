@@ -0,0 +1,333 @@
+/*
+ *  Copyright 2011 Daniel Arndt
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  @author: Daniel Arndt <danielarndt@gmail.com>
+ *
+ */
+
+// Package flowtbag calculates flow statistics from captured packets.
+//
+// Packets are decoded with Packet.Decode and added to a FlowTable, which
+// groups them into bi-directional flows. Finished flows are handed to a
+// callback, which will typically pass them on to an Exporter:
+//
+//	cfg := flowtbag.DefaultConfig
+//	exporter := flowtbag.NewCsvExporter(os.Stdout, cfg.Schema(), true)
+//	table, err := flowtbag.NewFlowTable(cfg, func(f *flowtbag.Flow) {
+//		f.Export(exporter)
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defrag := flowtbag.NewDefragmenter(cfg)
+//	for each captured frame {
+//		var pkt flowtbag.Packet
+//		err := pkt.Decode(data, timestamp)
+//		if err == flowtbag.ErrFragment {
+//			err = defrag.Add(&pkt, data)
+//		}
+//		if err == nil {
+//			table.AddPacket(&pkt)
+//		}
+//	}
+//	table.Flush()
+//	exporter.Close()
+package flowtbag
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The settings of a FlowTable.
+type Config struct {
+	// The time after which an inactive flow is expired.
+	FlowTimeout time.Duration
+	// The gap between packets after which a flow is considered idle.
+	IdleThreshold time.Duration
+	// The unit in which time based features are exported. Microseconds are
+	// exported as integers, and coarser units as decimals.
+	TimeUnit time.Duration
+	// The time a Defragmenter waits for the fragments of a datagram.
+	FragTimeout time.Duration
+	// The most memory, in bytes, a Defragmenter may hold fragments in.
+	FragMemory int64
+	// Whether flows are exported with the capture interface of their first
+	// packet.
+	ExportInterface bool
+	// The bins of the packet length histograms, in bytes.
+	LengthBins Binning
+	// The bins of the inter-arrival time histograms, in microseconds.
+	IatBins Binning
+	// The names of the features to export, as given by SelectFeatures. Nil
+	// exports every feature. The flow keys are always exported.
+	ExportFeatures []string
+
+	layout *featureLayout // The features selected, once worked out
+}
+
+// The settings used by flowtbag unless told otherwise.
+var DefaultConfig = Config{
+	FlowTimeout:   600 * time.Second,
+	IdleThreshold: time.Second,
+	TimeUnit:      time.Microsecond,
+	FragTimeout:   30 * time.Second,
+	FragMemory:    4 << 20,
+	// Below 64 bytes, up to 128, and so on to 1024 bytes and over.
+	LengthBins: EdgeBins(64, 128, 256, 512, 1024),
+	// Below 100us, up to 1ms, and so on to 1s and over.
+	IatBins: LogBins(10, 10000000, 6),
+}
+
+// Returns an error describing the first setting of cfg which is out of range,
+// or nil if all are usable.
+func (cfg *Config) Validate() error {
+	switch {
+	case cfg.FlowTimeout <= 0:
+		return fmt.Errorf("flow timeout %s is not positive", cfg.FlowTimeout)
+	case cfg.IdleThreshold <= 0:
+		return fmt.Errorf("idle threshold %s is not positive",
+			cfg.IdleThreshold)
+	case cfg.TimeUnit <= 0:
+		return fmt.Errorf("time unit %s is not positive", cfg.TimeUnit)
+	case cfg.FragTimeout <= 0:
+		return fmt.Errorf("fragment timeout %s is not positive",
+			cfg.FragTimeout)
+	case cfg.FragMemory <= 0:
+		return fmt.Errorf("fragment memory %d is not positive",
+			cfg.FragMemory)
+	case cfg.LengthBins.err != nil:
+		return fmt.Errorf("length histograms: %s", cfg.LengthBins.err)
+	case cfg.IatBins.err != nil:
+		return fmt.Errorf("inter-arrival histograms: %s", cfg.IatBins.err)
+	case cfg.ExportFeatures != nil && len(cfg.ExportFeatures) == 0:
+		return errors.New("no features selected")
+	}
+	for _, name := range cfg.ExportFeatures {
+		i, ok := featureIndex[name]
+		if !ok {
+			return fmt.Errorf("no feature named %q", name)
+		}
+		if !features[i].isEnabled(cfg) {
+			return features[i].disabledError()
+		}
+	}
+	return nil
+}
+
+// The error returned by AddPacket for a packet earlier than the last packet of
+// its flow. Such packets are routine where captures are merged, or interfaces
+// timestamp packets differently, and are not added to flows.
+var ErrReordered = errors.New("packet earlier than the last of its flow")
+
+// Holds the active flows, and assigns packets to them.
+type FlowTable struct {
+	cfg   Config
+	flows map[FlowKey]*Flow
+	done  func(*Flow)
+}
+
+// Creates a FlowTable. done is called for each finished flow which meets the
+// requirements of a bi-directional flow. An error is returned if cfg does not
+// pass Validate.
+func NewFlowTable(cfg Config, done func(*Flow)) (*FlowTable, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.layout = newLayout(&cfg)
+	return &FlowTable{
+		cfg:   cfg,
+		flows: make(map[FlowKey]*Flow),
+		done:  done,
+	}, nil
+}
+
+// An IPv4 or IPv6 address. IPv4 addresses are held in their IPv4-mapped IPv6
+// form (::ffff:a.b.c.d).
+type Addr [16]byte
+
+// Returns the IPv4-mapped form of a 4 byte IPv4 address.
+func addr4(b []byte) (a Addr) {
+	a[10], a[11] = 0xff, 0xff
+	copy(a[12:], b)
+	return a
+}
+
+// Returns whether the address is an IPv4 address.
+func (a Addr) Is4() bool {
+	return a[10] == 0xff && a[11] == 0xff &&
+		a == addr4(a[12:])
+}
+
+// Returns the address in its usual text form: dotted decimal for IPv4, and
+// colon separated hexadecimal for IPv6.
+func (a Addr) String() string {
+	return net.IP(a[:]).String()
+}
+
+// Identifies a flow. Both directions of a flow have the same key: the endpoint
+// with the greater address (or, for equal addresses, the greater port) comes
+// first.
+type FlowKey struct {
+	IP1       Addr
+	IP2       Addr
+	Port1     uint16
+	Port2     uint16
+	Proto     uint8
+	VLAN      uint16
+	InnerVLAN uint16
+	TunnelID  uint32
+}
+
+// Returns the key of the flow between two endpoints.
+func NewFlowKey(ip1 Addr, port1 uint16, ip2 Addr, port2 uint16,
+	proto uint8) FlowKey {
+	c := bytes.Compare(ip1[:], ip2[:])
+	if c > 0 || (c == 0 && port1 >= port2) {
+		return FlowKey{IP1: ip1, IP2: ip2, Port1: port1, Port2: port2,
+			Proto: proto}
+	}
+	return FlowKey{IP1: ip2, IP2: ip1, Port1: port2, Port2: port1,
+		Proto: proto}
+}
+
+// Returns a 32 bit FNV-1a hash of the key, for spreading flows across tables.
+func (k FlowKey) Hash() uint32 {
+	const (
+		offset = 2166136261
+		prime  = 16777619
+	)
+	h := uint32(offset)
+	for _, b := range k.IP1 {
+		h = (h ^ uint32(b)) * prime
+	}
+	for _, b := range k.IP2 {
+		h = (h ^ uint32(b)) * prime
+	}
+	for _, b := range [13]byte{byte(k.Port1 >> 8), byte(k.Port1),
+		byte(k.Port2 >> 8), byte(k.Port2), k.Proto,
+		byte(k.VLAN >> 8), byte(k.VLAN),
+		byte(k.InnerVLAN >> 8), byte(k.InnerVLAN),
+		byte(k.TunnelID >> 24), byte(k.TunnelID >> 16),
+		byte(k.TunnelID >> 8), byte(k.TunnelID)} {
+		h = (h ^ uint32(b)) * prime
+	}
+	return h
+}
+
+// Returns the key identifying the flow a packet belongs to. Packets on
+// different VLANs or in different tunnels belong to different flows.
+func (p *Packet) Key() FlowKey {
+	var k FlowKey
+	if p.Proto == IP_ICMP || p.Proto == IP_ICMP6 {
+		// The identifier and type are the same in both directions, so only
+		// the addresses are ordered.
+		k = NewFlowKey(p.SrcIP, 0, p.DstIP, 0, p.Proto)
+		k.Port1, k.Port2 = p.SrcPort, p.DstPort
+	} else {
+		k = NewFlowKey(p.SrcIP, p.SrcPort, p.DstIP, p.DstPort, p.Proto)
+	}
+	k.VLAN, k.InnerVLAN, k.TunnelID = p.VLAN, p.InnerVLAN, p.TunnelID
+	return k
+}
+
+// Returns a hash of the flows a packet may be added to. Tables which split the
+// flows between them by this hash see all the packets of a flow, along with any
+// ICMP errors about it.
+func (p *Packet) Hash() uint32 {
+	if p.HasInner {
+		return p.Inner.Hash()
+	}
+	return p.Key().Hash()
+}
+
+func (t *FlowTable) finish(flow *Flow) {
+	if flow.valid {
+		t.done(flow)
+	}
+}
+
+func (t *FlowTable) newFlow(ts FlowKey, pkt *Packet) {
+	f := new(Flow)
+	f.Init(pkt, &t.cfg)
+	t.flows[ts] = f
+}
+
+// Adds a decoded packet to the flow it belongs to, creating the flow if
+// needed. The packet is not retained. A packet earlier than the last packet of
+// its flow is skipped, and ErrReordered returned.
+func (t *FlowTable) AddPacket(pkt *Packet) error {
+	if pkt.HasInner {
+		// An ICMP error about a known flow is counted in that flow.
+		if flow, ok := t.flows[pkt.Inner]; ok {
+			flow.AddIcmpError(pkt)
+			return nil
+		}
+	}
+	ts := pkt.Key()
+	flow, exists := t.flows[ts]
+	if exists {
+		return_val := flow.Add(pkt)
+		if return_val == ADD_SUCCESS {
+			// The flow was successfully added
+			return nil
+		} else if return_val == ADD_REORDERED {
+			return ErrReordered
+		} else if return_val == ADD_CLOSED {
+			t.finish(flow)
+			delete(t.flows, ts)
+			return nil
+		} else {
+			// Already in, but has expired
+			t.finish(flow)
+			t.newFlow(ts, pkt)
+			return nil
+		}
+	} else {
+		// This flow does not yet exist in the map
+		t.newFlow(ts, pkt)
+		return nil
+	}
+}
+
+// Finishes the flows which have been inactive for longer than the flow timeout
+// at the given time, and returns how many there were.
+func (t *FlowTable) Expire(now time.Time) int {
+	count := 0
+	for tuple, flow := range t.flows {
+		if flow.CheckIdle(now.UnixMicro()) {
+			count++
+			t.finish(flow)
+			delete(t.flows, tuple)
+		}
+	}
+	return count
+}
+
+// Finishes all the active flows, leaving the table empty.
+func (t *FlowTable) Flush() {
+	for tuple, flow := range t.flows {
+		t.finish(flow)
+		delete(t.flows, tuple)
+	}
+}
+
+// Returns the number of active flows.
+func (t *FlowTable) Len() int {
+	return len(t.flows)
+}
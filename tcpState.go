@@ -17,7 +17,7 @@
  *
  */
 
-package main
+package flowtbag
 
 const (
 	TCP_FIN = 0x01
@@ -41,11 +41,11 @@ type tcpState struct {
 	State uint8
 }
 
-func tcpSet(find int64, flags int64) bool {
+func tcpSet(find uint8, flags uint8) bool {
 	return ((find & flags) == find)
 }
 
-func (t *tcpState) TcpUpdate(flags int64, dir int8, pdir int8) {
+func (t *tcpState) TcpUpdate(flags uint8, dir int8, pdir int8) {
 	if tcpSet(TCP_RST, flags) {
 		t.State = TCP_STATE_CLOSED
 	} else if tcpSet(TCP_FIN, flags) && (dir == pdir) {